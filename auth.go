@@ -0,0 +1,365 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	ScopeRead     = "read"
+	ScopeUpdate   = "update"
+	ScopeRollback = "rollback"
+	ScopeAdmin    = "admin"
+
+	// name of the key passed with --apikey
+	defaultKeyName = "default"
+	// identity of the callers when the endpoint doesn't require authentication
+	anonymousIdentity = "anonymous"
+
+	callerContextKey = "caller"
+)
+
+var (
+	ErrInvalidKeys = errors.New("invalid api keys")
+	ErrNoAPIKey    = errors.New("no api key is configured")
+)
+
+// AccessRule limits the services that a caller can act on, by name, stack and image. Each list matches any of its
+// glob patterns, every non-empty list has to match and empty lists match every service.
+type AccessRule struct {
+	Services []string `json:"services,omitempty"`
+	Stacks   []string `json:"stacks,omitempty"`
+	Images   []string `json:"images,omitempty"`
+	images   []imagePattern
+}
+
+// compile parses the image patterns of the rule.
+func (r *AccessRule) compile() error {
+	for _, pattern := range slices.Concat(r.Services, r.Stacks) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	r.images = nil
+	for _, image := range r.Images {
+		pattern, err := parseImagePattern(image)
+		if err != nil {
+			return err
+		}
+		r.images = append(r.images, pattern)
+	}
+
+	return nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows reports if the rule allows acting on the service with the name, stack and image. A nil rule allows
+// every service.
+func (r *AccessRule) allows(name, stack, image string) bool {
+	if r == nil {
+		return true
+	}
+
+	if len(r.Services) > 0 && !matchAny(r.Services, name) {
+		return false
+	}
+
+	if len(r.Stacks) > 0 && !matchAny(r.Stacks, stack) {
+		return false
+	}
+
+	if len(r.images) > 0 && !slices.ContainsFunc(r.images, func(p imagePattern) bool { return p.match(image) }) {
+		return false
+	}
+
+	return true
+}
+
+// restricted reports if the rule limits the services, a nil rule or one without patterns allows every service.
+func (r *AccessRule) restricted() bool {
+	return r != nil && (len(r.Services) > 0 || len(r.Stacks) > 0 || len(r.images) > 0)
+}
+
+// equal reports if both rules allow the same services, every rule without patterns is equal to the others.
+func (r *AccessRule) equal(other *AccessRule) bool {
+	if !r.restricted() || !other.restricted() {
+		return r.restricted() == other.restricted()
+	}
+
+	return slices.Equal(r.Services, other.Services) && slices.Equal(r.Stacks, other.Stacks) &&
+		slices.Equal(r.Images, other.Images)
+}
+
+func (r *AccessRule) allowsService(service swarm.Service) bool {
+	return r.allows(service.Spec.Name, service.Spec.Labels[stackNamespaceLabel], service.Spec.TaskTemplate.ContainerSpec.Image)
+}
+
+// Caller is the identity that requested an operation, and the actions and services it's allowed to use.
+type Caller struct {
+	Identity string
+	Scopes   []string
+	// Access limits the services of the operation, nil allows every service
+	Access *AccessRule
+	// Signed is set when the request was authenticated by its signature
+	Signed bool
+}
+
+// hasScope reports if the caller was granted the scope, admin grants every scope.
+func (c Caller) hasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope) || slices.Contains(c.Scopes, ScopeAdmin)
+}
+
+// validateScopes checks that there is at least one scope and that every scope is known.
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("no scopes")
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains([]string{ScopeRead, ScopeUpdate, ScopeRollback, ScopeAdmin}, scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	return nil
+}
+
+// APIKey is a named key of the http endpoint with the actions and services it's allowed to use.
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+	// SignatureOnly keys can only sign the requests, they aren't accepted as bearer tokens
+	SignatureOnly bool `json:"signatureOnly,omitempty"`
+	AccessRule
+	hash [sha256.Size]byte
+}
+
+func (k *APIKey) caller() Caller {
+	return Caller{Identity: k.Name, Scopes: k.Scopes, Access: &k.AccessRule}
+}
+
+// keyStore authenticates the api keys of the http endpoint.
+type keyStore struct {
+	keys []*APIKey
+}
+
+func (s *keyStore) add(key *APIKey) error {
+	if key.Name == "" {
+		return fmt.Errorf("%w: missing key name", ErrInvalidKeys)
+	}
+
+	if key.Key == "" {
+		return fmt.Errorf("%w: key %s is empty", ErrInvalidKeys, key.Name)
+	}
+
+	if err := validateScopes(key.Scopes); err != nil {
+		return fmt.Errorf("%w: key %s: %w", ErrInvalidKeys, key.Name, err)
+	}
+
+	if err := key.compile(); err != nil {
+		return fmt.Errorf("%w: key %s: %w", ErrInvalidKeys, key.Name, err)
+	}
+
+	for _, other := range s.keys {
+		if other.Name == key.Name {
+			return fmt.Errorf("%w: key %s is defined twice", ErrInvalidKeys, key.Name)
+		}
+	}
+
+	key.hash = sha256.Sum256([]byte(key.Key))
+	s.keys = append(s.keys, key)
+
+	return nil
+}
+
+// load adds the keys of a JSON file with a list of keys, like a swarm secret.
+func (s *keyStore) load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read the api keys file: %w", err)
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidKeys, err)
+	}
+
+	for _, key := range keys {
+		if err := s.add(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lookup returns the key that matches the value. The hashes of every key are compared in constant time, so the
+// time doesn't depend on which key, or how much of it, matched.
+func (s *keyStore) lookup(value string) (*APIKey, bool) {
+	hash := sha256.Sum256([]byte(value))
+
+	var found *APIKey
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash[:]) == 1 && !key.SignatureOnly {
+			found = key
+		}
+	}
+
+	return found, found != nil
+}
+
+// newKeyStore loads the key passed on the command line and the keys file, if any.
+func newKeyStore(apiKey, keysFile string) (*keyStore, error) {
+	store := &keyStore{}
+
+	if apiKey != "" {
+		if err := store.add(&APIKey{Name: defaultKeyName, Key: apiKey, Scopes: []string{ScopeAdmin}}); err != nil {
+			return nil, err
+		}
+	}
+
+	if keysFile != "" {
+		if err := store.load(keysFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// authenticator validates the bearer tokens of the http endpoint, which can be api keys or OIDC tokens, and the
+// requests signed with an api key.
+type authenticator struct {
+	keys *keyStore
+	oidc *oidcVerifier
+	// signedRoutes are the routes that only accept signed requests
+	signedRoutes []string
+	replays      replayCache
+}
+
+// newAuthenticator fails if there is no way to authenticate the callers, unless allowNoAuth is set.
+func newAuthenticator(keys *keyStore, oidc *oidcVerifier, allowNoAuth bool) (*authenticator, error) {
+	if len(keys.keys) == 0 && oidc == nil && !allowNoAuth {
+		return nil, fmt.Errorf("%w, set an api key or allow the endpoint without authentication", ErrNoAPIKey)
+	}
+
+	return &authenticator{keys: keys, oidc: oidc}, nil
+}
+
+// callerFrom returns the caller authenticated by the middleware.
+func callerFrom(c echo.Context) Caller {
+	if caller, ok := c.Get(callerContextKey).(Caller); ok {
+		return caller
+	}
+
+	return Caller{}
+}
+
+// middleware validates the signature or the bearer token of the request and saves its caller. The token is checked
+// as an api key first and then as an OIDC token. When there are no keys the requests are allowed as an anonymous
+// admin.
+func (a *authenticator) middleware() echo.MiddlewareFunc {
+	if len(a.keys.keys) == 0 && a.oidc == nil {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set(callerContextKey, Caller{Identity: anonymousIdentity, Scopes: []string{ScopeAdmin}})
+				return next(c)
+			}
+		}
+	}
+
+	keyAuth := middleware.KeyAuth(func(value string, c echo.Context) (bool, error) {
+		if key, ok := a.keys.lookup(value); ok {
+			c.Set(callerContextKey, key.caller())
+			return true, nil
+		}
+
+		// tokens have a header, payload and signature separated by dots
+		if a.oidc == nil || strings.Count(value, ".") != 2 {
+			return false, nil
+		}
+
+		caller, err := a.oidc.verify(c.Request().Context(), value)
+		if err != nil {
+			slog.Warn("Rejected oidc token", "error", err.Error())
+			return false, nil
+		}
+
+		c.Set(callerContextKey, caller)
+
+		return true, nil
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withKey := keyAuth(next)
+
+		return func(c echo.Context) error {
+			if c.Request().Header.Get(signatureHeader) == "" {
+				return withKey(c)
+			}
+
+			caller, err := a.verifySignature(c)
+			if err != nil {
+				slog.Warn("Rejected signed request", "error", err.Error())
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid signature")
+			}
+
+			c.Set(callerContextKey, caller)
+
+			return next(c)
+		}
+	}
+}
+
+// requireScope returns a middleware that rejects the callers without the scope.
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if caller := callerFrom(c); !caller.hasScope(scope) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("%s doesn't have the %s scope", caller.Identity, scope))
+			}
+
+			return next(c)
+		}
+	}
+}
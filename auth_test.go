@@ -0,0 +1,214 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+const testKeys = `[
+  {"name": "ci", "key": "ci-secret", "scopes": ["update", "read"], "stacks": ["shop"], "images": ["mycompany/*"]},
+  {"name": "viewer", "key": "viewer-secret", "scopes": ["read"]}
+]`
+
+func TestKeyStore(t *testing.T) {
+	assert := test.New(t)
+
+	keys, err := newKeyStore("", "")
+	assert.NoError(err)
+	assert.Empty(keys.keys)
+
+	_, err = newAuthenticator(keys, nil, false)
+	assert.ErrorIs(err, ErrNoAPIKey)
+
+	_, err = newAuthenticator(keys, nil, true)
+	assert.NoError(err)
+
+	filename := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(os.WriteFile(filename, []byte(testKeys), 0o600))
+
+	keys, err = newKeyStore("secret", filename)
+	assert.NoError(err)
+	assert.Len(keys.keys, 3)
+
+	key, ok := keys.lookup("ci-secret")
+	assert.True(ok)
+	assert.Equal("ci", key.Name)
+
+	caller := key.caller()
+	assert.True(caller.hasScope(ScopeUpdate))
+	assert.False(caller.hasScope(ScopeRollback))
+	assert.True(caller.Access.allows("shop_web", "shop", "mycompany/web:latest"))
+	assert.False(caller.Access.allows("shop_web", "shop", "nginx"))
+	assert.False(caller.Access.allows("blog_web", "blog", "mycompany/web:latest"))
+
+	key, ok = keys.lookup("secret")
+	assert.True(ok)
+	assert.True(key.caller().hasScope(ScopeRollback))
+	assert.True(key.caller().Access.allows("any", "", "nginx"))
+
+	_, ok = keys.lookup("ci-secre")
+	assert.False(ok)
+
+	assert.NoError(os.WriteFile(filename, []byte(`[{"name": "ci", "key": "", "scopes": ["update"]}]`), 0o600))
+	_, err = newKeyStore("", filename)
+	assert.ErrorIs(err, ErrInvalidKeys)
+
+	assert.NoError(os.WriteFile(filename, []byte(`[{"name": "ci", "key": "x", "scopes": ["deploy"]}]`), 0o600))
+	_, err = newKeyStore("", filename)
+	assert.ErrorIs(err, ErrInvalidKeys)
+}
+
+func TestScopedKeys(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name, stack, image string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.Labels = map[string]string{stackNamespaceLabel: stack}
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: image}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	services := func() []swarm.Service {
+		return []swarm.Service{
+			newService("shop_web", "shop", "mycompany/web:latest"),
+			newService("shop_cache", "shop", "redis:7"),
+			newService("blog_web", "blog", "mycompany/blog:latest"),
+		}
+	}
+
+	var updated []string
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return services(), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		for _, service := range services() {
+			if service.ID == serviceID {
+				return service, nil, nil
+			}
+		}
+
+		return swarm.Service{}, nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updated = append(updated, serviceID)
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	filename := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(os.WriteFile(filename, []byte(testKeys), 0o600))
+
+	keys, err := newKeyStore("admin-secret", filename)
+	assert.NoError(err)
+
+	s := &Swarm{client: &mock, MaxThreads: 1}
+	ts := httptest.NewServer(newServer(context.TODO(), s, &authenticator{keys: keys}).echo(false))
+	defer ts.Close()
+
+	ci := newRemoteClient(ts.URL, "ci-secret")
+	response, err := ci.Update(context.TODO(), UpdateRequest{Stacks: []string{"shop", "blog"}})
+	assert.NoError(err)
+	assert.Equal([]string{"shop_web"}, updated)
+	assert.Len(response.Services, 3)
+
+	for _, result := range response.Services {
+		if result.Service != "shop_web" {
+			assert.Equal(StatusSkipped, result.Status)
+			assert.Equal("not allowed for ci", result.Reason)
+		}
+	}
+
+	list, err := ci.Services(context.TODO())
+	assert.NoError(err)
+	assert.Len(list, 1)
+
+	_, err = ci.Explain(context.TODO(), "blog_web")
+	assert.ErrorContains(err, "403")
+
+	_, err = ci.Rollback(context.TODO(), "shop_web")
+	assert.ErrorContains(err, "403")
+
+	entries, err := ci.History(context.TODO(), "", 0)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal("ci", entries[0].Identity)
+
+	viewer := newRemoteClient(ts.URL, "viewer-secret")
+	list, err = viewer.Services(context.TODO())
+	assert.NoError(err)
+	assert.Len(list, 3)
+
+	// the history and the jobs of the other stacks aren't visible to the scoped key
+	admin := newRemoteClient(ts.URL, "admin-secret")
+	adminResponse, err := admin.Update(context.TODO(), UpdateRequest{Stacks: []string{"blog"}})
+	assert.NoError(err)
+
+	entries, err = viewer.History(context.TODO(), "", 0)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	entries, err = ci.History(context.TODO(), "", 0)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal("shop_web", entries[0].Service)
+	assert.Equal("shop", entries[0].Stack)
+
+	jobs, err := ci.Jobs(context.TODO())
+	assert.NoError(err)
+	assert.Len(jobs, 1)
+	assert.Equal(response.Job, jobs[0].ID)
+
+	_, err = ci.Job(context.TODO(), adminResponse.Job)
+	assert.ErrorContains(err, "403")
+
+	jobs, err = viewer.Jobs(context.TODO())
+	assert.NoError(err)
+	assert.Len(jobs, 2)
+
+	// a job of another caller only shows the results of the allowed services
+	_, err = admin.Update(context.TODO(), UpdateRequest{Stacks: []string{"shop", "blog"}, Force: true})
+	assert.NoError(err)
+
+	jobs, err = ci.Jobs(context.TODO())
+	assert.NoError(err)
+	assert.Len(jobs, 2)
+	assert.Nil(jobs[0].Request)
+	assert.Len(jobs[0].Result.Services, 1)
+	assert.Equal("shop_web", jobs[0].Result.Services[0].Service)
+
+	_, err = viewer.Update(context.TODO(), UpdateRequest{Services: []string{"shop_web"}})
+	assert.ErrorContains(err, "viewer doesn't have the update scope")
+}
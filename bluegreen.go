@@ -0,0 +1,383 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	strategyBlueGreen       = "blue-green"
+	oldServiceRemove        = "remove"
+	oldServiceScaleDown     = "scale-down"
+	defaultBlueGreenTimeout = 5 * time.Minute
+)
+
+// ErrBlueGreenFailed is returned when the cloned service didn't become healthy.
+var ErrBlueGreenFailed = errors.New("blue/green update failed")
+
+// trafficConfig holds the parts of a service spec that route traffic to it.
+type trafficConfig struct {
+	labels  map[string]string
+	aliases map[string][]string
+	ports   []swarm.PortConfig
+}
+
+// blueGreenSettings holds the blue/green configuration of a service.
+type blueGreenSettings struct {
+	labels  []string
+	old     string
+	timeout time.Duration
+}
+
+// blueGreenConfig parses the blue/green labels of a service.
+func blueGreenConfig(labels map[string]string) (blueGreenSettings, error) {
+	config := blueGreenSettings{old: oldServiceRemove, timeout: defaultBlueGreenTimeout}
+
+	for _, pattern := range strings.Split(labels[blueGreenLabelsLabel], ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			config.labels = append(config.labels, pattern)
+		}
+	}
+
+	if value, ok := labels[blueGreenTimeoutLabel]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s label: %w", blueGreenTimeoutLabel, err)
+		}
+		config.timeout = timeout
+	}
+
+	if value, ok := labels[blueGreenOldLabel]; ok {
+		if value != oldServiceRemove && value != oldServiceScaleDown {
+			return config, fmt.Errorf("invalid %s label: %s", blueGreenOldLabel, value)
+		}
+		config.old = value
+	}
+
+	return config, nil
+}
+
+// blueGreenName returns the name of the clone, alternating between the blue and green suffixes.
+func blueGreenName(name string) string {
+	if base, ok := strings.CutSuffix(name, "-green"); ok {
+		return base + "-blue"
+	}
+
+	if base, ok := strings.CutSuffix(name, "-blue"); ok {
+		return base + "-green"
+	}
+
+	return name + "-green"
+}
+
+// matchLabel reports if the label key matches any of the patterns. Patterns ending with * match by prefix.
+func matchLabel(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractTraffic removes the traffic labels, network aliases and published ports from the spec and returns them.
+func extractTraffic(spec *swarm.ServiceSpec, patterns []string) trafficConfig {
+	traffic := trafficConfig{labels: map[string]string{}, aliases: map[string][]string{}}
+
+	for key, value := range spec.Labels {
+		if matchLabel(key, patterns) {
+			traffic.labels[key] = value
+			delete(spec.Labels, key)
+		}
+	}
+
+	for i, network := range spec.TaskTemplate.Networks {
+		if len(network.Aliases) > 0 {
+			traffic.aliases[network.Target] = network.Aliases
+			spec.TaskTemplate.Networks[i].Aliases = nil
+		}
+	}
+
+	if spec.EndpointSpec != nil {
+		traffic.ports = spec.EndpointSpec.Ports
+		spec.EndpointSpec.Ports = nil
+	}
+
+	return traffic
+}
+
+// empty reports if there is no traffic config.
+func (t trafficConfig) empty() bool {
+	return len(t.labels) == 0 && len(t.aliases) == 0 && len(t.ports) == 0
+}
+
+// applyTraffic adds the traffic labels, network aliases and published ports to the spec.
+func applyTraffic(spec *swarm.ServiceSpec, traffic trafficConfig) {
+	if spec.Labels == nil {
+		spec.Labels = map[string]string{}
+	}
+
+	for key, value := range traffic.labels {
+		spec.Labels[key] = value
+	}
+
+	for i, network := range spec.TaskTemplate.Networks {
+		if aliases, ok := traffic.aliases[network.Target]; ok {
+			spec.TaskTemplate.Networks[i].Aliases = aliases
+		}
+	}
+
+	if len(traffic.ports) > 0 {
+		if spec.EndpointSpec == nil {
+			spec.EndpointSpec = &swarm.EndpointSpec{}
+		}
+		spec.EndpointSpec.Ports = traffic.ports
+	}
+}
+
+// copySpec returns a deep copy of the service spec.
+func copySpec(spec swarm.ServiceSpec) (swarm.ServiceSpec, error) {
+	var clone swarm.ServiceSpec
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return clone, fmt.Errorf("failed to copy service spec: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return clone, fmt.Errorf("failed to copy service spec: %w", err)
+	}
+
+	return clone, nil
+}
+
+// blueGreenHealthy checks that all the tasks of the service are running.
+func (c *Swarm) blueGreenHealthy(ctx context.Context, service swarm.Service) (bool, error) {
+	tasks, err := c.client.TaskList(ctx, types.TaskListOptions{Filters: filters.NewArgs(
+		filters.Arg("service", service.ID),
+		filters.Arg("desired-state", "running"),
+	)})
+	if err != nil {
+		return false, fmt.Errorf("TaskList failed: %w", err)
+	}
+
+	running := 0
+	for _, task := range tasks {
+		switch task.Status.State {
+		case swarm.TaskStateFailed, swarm.TaskStateRejected:
+			return false, fmt.Errorf("%w: task %s is %s: %s", ErrBlueGreenFailed, task.ID, task.Status.State, task.Status.Err)
+		case swarm.TaskStateRunning:
+			running++
+		}
+	}
+
+	desired := len(tasks)
+	if service.Spec.Mode.Replicated != nil && service.Spec.Mode.Replicated.Replicas != nil {
+		desired = int(*service.Spec.Mode.Replicated.Replicas)
+	}
+
+	return running > 0 && running >= desired, nil
+}
+
+// waitBlueGreen waits until the cloned service is healthy or the timeout expires.
+func (c *Swarm) waitBlueGreen(ctx context.Context, service swarm.Service, timeout time.Duration) error {
+	ticker := time.NewTicker(c.pollEvery())
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		healthy, err := c.blueGreenHealthy(ctx, service)
+		if err != nil {
+			return err
+		}
+
+		if healthy {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: service %s not healthy after %s", ErrBlueGreenFailed, service.Spec.Name, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeStaleClone removes a service left with the name of the clone, like the old service of a previous scale-down
+// update. A service with that name that still receives traffic isn't touched, and the update fails.
+func (c *Swarm) removeStaleClone(ctx context.Context, name string, patterns []string) error {
+	existing, _, err := c.client.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("ServiceInspect failed: %w", err)
+	}
+
+	spec, err := copySpec(existing.Spec)
+	if err != nil {
+		return err
+	}
+
+	if !extractTraffic(&spec, patterns).empty() {
+		return fmt.Errorf("%w: service %s already exists and receives traffic", ErrBlueGreenFailed, name)
+	}
+
+	slog.Warn("Removing stale blue/green clone", "clone", name)
+	if err := c.client.ServiceRemove(ctx, existing.ID); err != nil {
+		return fmt.Errorf("failed to remove service %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// abortBlueGreen removes the clone after a failed update and, if the traffic was already taken out of the old
+// service, gives it back. It runs even if the context is done, so the old service isn't left without traffic.
+func (c *Swarm) abortBlueGreen(ctx context.Context, service, clone swarm.Service, traffic trafficConfig, restore bool, cause error) error {
+	ctx = context.WithoutCancel(ctx)
+	slog.Warn("Blue/green update failed, removing the clone", "service", service.Spec.Name, "clone", clone.Spec.Name,
+		"error", cause)
+
+	// the clone goes first, as it may hold the published ports
+	if err := c.client.ServiceRemove(ctx, clone.ID); err != nil {
+		return errors.Join(cause, fmt.Errorf("failed to remove service %s: %w", clone.Spec.Name, err))
+	}
+
+	if !restore {
+		return cause
+	}
+
+	old, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("ServiceInspect failed: %w", err))
+	}
+
+	applyTraffic(&old.Spec, traffic)
+	if _, err := c.client.ServiceUpdate(ctx, old.ID, old.Version, old.Spec, types.ServiceUpdateOptions{}); err != nil {
+		return errors.Join(cause, fmt.Errorf("failed to restore traffic of service %s: %w", service.Spec.Name, err))
+	}
+
+	return cause
+}
+
+// updateBlueGreen clones the service with the new image, waits for the clone to become healthy, moves the traffic
+// labels, network aliases and published ports to the clone and then removes or scales down the old service. If any
+// step fails the clone is removed and the traffic is given back to the old service. The ID of the clone is returned, or
+// an empty one if the service is scaled down and there is nothing to deploy.
+func (c *Swarm) updateBlueGreen(ctx context.Context, service swarm.Service, updateOpts types.ServiceUpdateOptions) (string, error) {
+	if service.Spec.Mode.Replicated != nil && service.Spec.Mode.Replicated.Replicas != nil && *service.Spec.Mode.Replicated.Replicas == 0 {
+		slog.Debug("Skipping scaled down blue/green service", "service", service.Spec.Name)
+
+		return "", nil
+	}
+
+	config, err := blueGreenConfig(service.Spec.Labels)
+	if err != nil {
+		return "", err
+	}
+
+	spec, err := copySpec(service.Spec)
+	if err != nil {
+		return "", err
+	}
+
+	spec.Name = blueGreenName(service.Spec.Name)
+	traffic := extractTraffic(&spec, config.labels)
+
+	if err := c.removeStaleClone(ctx, spec.Name, config.labels); err != nil {
+		return "", err
+	}
+
+	slog.Debug("Creating blue/green clone", "service", service.Spec.Name, "clone", spec.Name)
+	response, err := c.client.ServiceCreate(ctx, spec, types.ServiceCreateOptions{EncodedRegistryAuth: updateOpts.EncodedRegistryAuth})
+	if err != nil {
+		return "", fmt.Errorf("failed to create service %s: %w", spec.Name, err)
+	}
+
+	clone := swarm.Service{ID: response.ID, Spec: spec}
+
+	if err := c.waitBlueGreen(ctx, clone, config.timeout); err != nil {
+		return "", c.abortBlueGreen(ctx, service, clone, traffic, false, err)
+	}
+
+	// take the traffic out of the old service
+	old, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+	if err != nil {
+		return "", c.abortBlueGreen(ctx, service, clone, traffic, false, fmt.Errorf("ServiceInspect failed: %w", err))
+	}
+
+	extractTraffic(&old.Spec, config.labels)
+	if _, err := c.client.ServiceUpdate(ctx, old.ID, old.Version, old.Spec, types.ServiceUpdateOptions{}); err != nil {
+		return "", c.abortBlueGreen(ctx, service, clone, traffic, false,
+			fmt.Errorf("failed to remove traffic from service %s: %w", service.Spec.Name, err))
+	}
+
+	// and send it to the clone
+	current, _, err := c.client.ServiceInspectWithRaw(ctx, clone.ID, types.ServiceInspectOptions{})
+	if err != nil {
+		return "", c.abortBlueGreen(ctx, service, clone, traffic, true, fmt.Errorf("ServiceInspect failed: %w", err))
+	}
+
+	applyTraffic(&current.Spec, traffic)
+	if _, err := c.client.ServiceUpdate(ctx, current.ID, current.Version, current.Spec, updateOpts); err != nil {
+		return "", c.abortBlueGreen(ctx, service, clone, traffic, true,
+			fmt.Errorf("failed to move traffic to service %s: %w", spec.Name, err))
+	}
+
+	if config.old == oldServiceScaleDown && old.Spec.Mode.Replicated != nil {
+		old, _, err = c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			return "", c.abortBlueGreen(ctx, service, clone, traffic, true, fmt.Errorf("ServiceInspect failed: %w", err))
+		}
+
+		replicas := uint64(0)
+		old.Spec.Mode.Replicated.Replicas = &replicas
+		if _, err := c.client.ServiceUpdate(ctx, old.ID, old.Version, old.Spec, types.ServiceUpdateOptions{}); err != nil {
+			return "", c.abortBlueGreen(ctx, service, clone, traffic, true,
+				fmt.Errorf("failed to scale down service %s: %w", service.Spec.Name, err))
+		}
+	} else if err := c.client.ServiceRemove(ctx, service.ID); err != nil {
+		return "", c.abortBlueGreen(ctx, service, clone, traffic, true,
+			fmt.Errorf("failed to remove service %s: %w", service.Spec.Name, err))
+	}
+
+	slog.Info("Updated service", "service", service.Spec.Name, "clone", spec.Name, "image", spec.TaskTemplate.ContainerSpec.Image)
+
+	return clone.ID, nil
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestBlueGreenName(t *testing.T) {
+	assert := test.New(t)
+
+	assert.Equal("app-green", blueGreenName("app"))
+	assert.Equal("app-blue", blueGreenName("app-green"))
+	assert.Equal("app-green", blueGreenName("app-blue"))
+}
+
+func TestTraffic(t *testing.T) {
+	assert := test.New(t)
+
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Labels: map[string]string{
+			"traefik.enable":              "true",
+			"traefik.http.routers.a.rule": "Host(`a`)",
+			"other":                       "value",
+		}},
+		TaskTemplate: swarm.TaskSpec{Networks: []swarm.NetworkAttachmentConfig{{Target: "net", Aliases: []string{"app"}}}},
+		EndpointSpec: &swarm.EndpointSpec{Ports: []swarm.PortConfig{{TargetPort: 80, PublishedPort: 8080}}},
+	}
+
+	traffic := extractTraffic(&spec, []string{"traefik.*"})
+	assert.Len(traffic.labels, 2)
+	assert.Equal(map[string]string{"other": "value"}, spec.Labels)
+	assert.Empty(spec.TaskTemplate.Networks[0].Aliases)
+	assert.Empty(spec.EndpointSpec.Ports)
+
+	applyTraffic(&spec, traffic)
+	assert.Len(spec.Labels, 3)
+	assert.Equal([]string{"app"}, spec.TaskTemplate.Networks[0].Aliases)
+	assert.Len(spec.EndpointSpec.Ports, 1)
+}
+
+// blueGreenMock serves the services of the map by ID or name, and records the removed ones.
+type blueGreenMock struct {
+	dockerClientMock
+	services map[string]*swarm.Service
+	removed  []string
+}
+
+func newBlueGreenServices() map[string]*swarm.Service {
+	replicas := uint64(2)
+
+	return map[string]*swarm.Service{
+		"1": {
+			ID: "1",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name: "app",
+					Labels: map[string]string{
+						strategyLabel:        strategyBlueGreen,
+						blueGreenLabelsLabel: "traefik.*",
+						"traefik.enable":     "true",
+					},
+				},
+				Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "app:latest"}},
+			},
+		},
+	}
+}
+
+func newBlueGreenMock(services map[string]*swarm.Service) *blueGreenMock {
+	mock := &blueGreenMock{services: services}
+
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceCreateFn = func(_ context.Context, spec swarm.ServiceSpec, _ types.ServiceCreateOptions) (swarm.ServiceCreateResponse, error) {
+		services["2"] = &swarm.Service{ID: "2", Spec: spec}
+
+		return swarm.ServiceCreateResponse{ID: "2"}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		for id, service := range services {
+			if id == serviceID || service.Spec.Name == serviceID {
+				return *service, nil, nil
+			}
+		}
+
+		return swarm.Service{}, nil, errdefs.NotFound(fmt.Errorf("service %s not found", serviceID))
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, spec swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		services[serviceID].Spec = spec
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+	mock.ServiceRemoveFn = func(_ context.Context, serviceID string) error {
+		mock.removed = append(mock.removed, serviceID)
+		delete(services, serviceID)
+
+		return nil
+	}
+	mock.TaskListFn = func(_ context.Context, _ types.TaskListOptions) ([]swarm.Task, error) {
+		task := swarm.Task{}
+		task.Status.State = swarm.TaskStateRunning
+
+		return []swarm.Task{task, task}, nil
+	}
+
+	return mock
+}
+
+func TestUpdateBlueGreen(t *testing.T) {
+	assert := test.New(t)
+
+	services := newBlueGreenServices()
+	mock := newBlueGreenMock(services)
+	create := mock.ServiceCreateFn
+	mock.ServiceCreateFn = func(ctx context.Context, spec swarm.ServiceSpec, opts types.ServiceCreateOptions) (swarm.ServiceCreateResponse, error) {
+		assert.Equal("app-green", spec.Name)
+		assert.NotContains(spec.Labels, "traefik.enable")
+
+		return create(ctx, spec, opts)
+	}
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	result, err := s.updateService(context.TODO(), *services["1"], imageTarget{})
+	assert.NoError(err)
+	assert.Equal(StatusUpdated, result.Status)
+
+	assert.Equal([]string{"1"}, mock.removed)
+	assert.Equal("true", services["2"].Spec.Labels["traefik.enable"])
+	assert.Equal("app:latest@"+newDigest, services["2"].Spec.TaskTemplate.ContainerSpec.Image)
+
+	// the update is recorded on the clone that replaced the service
+	state, ok := s.state.get("2")
+	assert.True(ok)
+	assert.False(state.lastUpdate.IsZero())
+}
+
+func TestBlueGreenSkipped(t *testing.T) {
+	assert := test.New(t)
+
+	// nothing is deployed for a scaled down service
+	services := newBlueGreenServices()
+	*services["1"].Spec.Mode.Replicated.Replicas = 0
+	mock := newBlueGreenMock(services)
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	result, err := s.updateService(context.TODO(), *services["1"], imageTarget{})
+	assert.NoError(err)
+	assert.Equal(StatusSkipped, result.Status)
+	assert.NotEmpty(result.Reason)
+	assert.NotContains(services, "2")
+
+	state, _ := s.state.get("1")
+	assert.True(state.lastUpdate.IsZero())
+
+	// update-only services can't use the strategy, and unknown strategies aren't replaced by a rolling update
+	for _, labels := range []map[string]string{
+		{strategyLabel: strategyBlueGreen, updateOnlyLabel: "true"},
+		{strategyLabel: "red-black"},
+	} {
+		services = newBlueGreenServices()
+		services["1"].Spec.Labels = labels
+		mock = newBlueGreenMock(services)
+		updated := false
+		mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+			updated = true
+
+			return swarm.ServiceUpdateResponse{}, nil
+		}
+
+		s = Swarm{client: mock, pollInterval: time.Millisecond}
+		_, err = s.updateService(context.TODO(), *services["1"], imageTarget{})
+		assert.ErrorContains(err, "strategy")
+		assert.False(updated)
+		assert.NotContains(services, "2")
+	}
+}
+
+func TestBlueGreenRestoresTraffic(t *testing.T) {
+	assert := test.New(t)
+
+	services := newBlueGreenServices()
+	mock := newBlueGreenMock(services)
+	update := mock.ServiceUpdateFn
+	mock.ServiceUpdateFn = func(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec, opts types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		if serviceID == "2" {
+			return swarm.ServiceUpdateResponse{}, errors.New("port already in use")
+		}
+
+		return update(ctx, serviceID, version, spec, opts)
+	}
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	_, err := s.updateService(context.TODO(), *services["1"], imageTarget{})
+	assert.ErrorContains(err, "port already in use")
+
+	// the clone is removed and the old service gets its traffic back
+	assert.Equal([]string{"2"}, mock.removed)
+	assert.Equal("true", services["1"].Spec.Labels["traefik.enable"])
+}
+
+func TestBlueGreenStaleClone(t *testing.T) {
+	assert := test.New(t)
+
+	// a clone left without traffic is replaced
+	services := newBlueGreenServices()
+	services["3"] = &swarm.Service{ID: "3", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "app-green"}}}
+	mock := newBlueGreenMock(services)
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	_, err := s.updateService(context.TODO(), *services["1"], imageTarget{})
+	assert.NoError(err)
+	assert.Equal([]string{"3", "1"}, mock.removed)
+
+	// but not if it receives traffic
+	services = newBlueGreenServices()
+	services["3"] = &swarm.Service{ID: "3", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{
+		Name:   "app-green",
+		Labels: map[string]string{"traefik.enable": "true"},
+	}}}
+	mock = newBlueGreenMock(services)
+
+	s = Swarm{client: mock, pollInterval: time.Millisecond}
+	_, err = s.updateService(context.TODO(), *services["1"], imageTarget{})
+	assert.ErrorIs(err, ErrBlueGreenFailed)
+	assert.Empty(mock.removed)
+	assert.NotContains(services, "2")
+}
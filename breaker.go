@@ -0,0 +1,130 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// unavailableError is returned for the lookups on a registry while its circuit breaker is open.
+type unavailableError struct {
+	domain   string
+	failures int
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("registry %s is unavailable after %d consecutive failures", e.domain, e.failures)
+}
+
+// circuitBreaker stops the lookups on a registry after consecutive failures. The breaker stays open for the rest of
+// the run that opened it, and the first lookup of the next run is a probe that closes it if it succeeds.
+type circuitBreaker struct {
+	failures int
+	open     bool
+	// opened is the run that opened the breaker, or the last one that failed the probe
+	opened uint64
+	// probe is closed when the running probe finishes
+	probe chan struct{}
+}
+
+// unavailable reports if the error means that the registry can't be reached, the registries that answer with an
+// auth or not found error are working.
+func unavailable(err error) bool {
+	class := classifyError(err)
+	return class == ErrorNetwork || class == ErrorServer
+}
+
+// allowLookup waits until a lookup can be sent to the registry, and returns the function that records its outcome.
+// It fails if the breaker of the registry is open.
+func (r *registryState) allowLookup(ctx context.Context, domain string, run uint64, threshold int) (func(error), error) {
+	if threshold <= 0 {
+		return func(error) {}, nil
+	}
+
+	for {
+		r.mu.Lock()
+		breaker := &r.status(domain).breaker
+
+		if !breaker.open {
+			r.mu.Unlock()
+			return func(err error) { r.recordLookup(domain, run, threshold, err, false) }, nil
+		}
+
+		if run != 0 && breaker.opened == run {
+			failures := breaker.failures
+			r.mu.Unlock()
+			return nil, &unavailableError{domain: domain, failures: failures}
+		}
+
+		if breaker.probe == nil {
+			breaker.probe = make(chan struct{})
+			r.mu.Unlock()
+			slog.Info("Probing unavailable registry", "registry", domain)
+
+			return func(err error) { r.recordLookup(domain, run, threshold, err, true) }, nil
+		}
+
+		// wait for the probe of another lookup of the run
+		probe := breaker.probe
+		r.mu.Unlock()
+
+		select {
+		case <-probe:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *registryState) recordLookup(domain string, run uint64, threshold int, err error, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	breaker := &r.status(domain).breaker
+
+	if probe {
+		close(breaker.probe)
+		breaker.probe = nil
+	}
+
+	if classifyError(err) == ErrorCanceled {
+		return
+	}
+
+	if err == nil || !unavailable(err) {
+		if breaker.open {
+			slog.Info("Registry is available again, closing its circuit breaker", "registry", domain)
+		}
+		breaker.failures = 0
+		breaker.open = false
+
+		return
+	}
+
+	breaker.failures++
+
+	if probe || (!breaker.open && breaker.failures >= threshold) {
+		if !breaker.open {
+			slog.Warn("Registry is unavailable, opening its circuit breaker", "registry", domain,
+				"failures", breaker.failures)
+		}
+		breaker.open = true
+		breaker.opened = run
+	}
+}
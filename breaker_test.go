@@ -0,0 +1,94 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestRegistryCircuitBreaker(t *testing.T) {
+	assert := test.New(t)
+
+	images := []string{"down.local/app0", "down.local/app1", "down.local/app2", "down.local/app3", "up.local/app"}
+
+	var down atomic.Bool
+	var lookups atomic.Int32
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return newImageServices(images...), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, image, _ string) (registry.DistributionInspect, error) {
+		if imageDomain(image) == "down.local" {
+			lookups.Add(1)
+			if down.Load() {
+				return registry.DistributionInspect{}, errdefs.System(errors.New("received unexpected HTTP status: 502 Bad Gateway"))
+			}
+		}
+
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1, RegistryFailureThreshold: 2, Retry: RetryPolicy{Attempts: 1}}
+
+	statuses := func(run *RunResult) []string {
+		var statuses []string
+		for _, service := range run.Services {
+			statuses = append(statuses, service.Status)
+		}
+
+		return statuses
+	}
+
+	// the breaker opens after two failures, the other registry keeps working
+	down.Store(true)
+	run, err := s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal([]string{StatusFailed, StatusFailed, StatusRegistryUnavailable, StatusRegistryUnavailable, StatusOutdated},
+		statuses(run))
+	assert.Equal(ErrorServer, run.Services[0].ErrorClass)
+	assert.Equal("registry down.local is unavailable after 2 consecutive failures", run.Services[2].Reason)
+	assert.Equal(int32(2), lookups.Load())
+
+	// the probe of the next run fails, so the breaker opens again
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal([]string{StatusFailed, StatusRegistryUnavailable, StatusRegistryUnavailable, StatusRegistryUnavailable, StatusOutdated},
+		statuses(run))
+	assert.Equal(int32(3), lookups.Load())
+
+	// the probe works and the breaker closes
+	down.Store(false)
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal([]string{StatusOutdated, StatusOutdated, StatusOutdated, StatusOutdated, StatusOutdated}, statuses(run))
+	assert.Equal(int32(7), lookups.Load())
+
+	// the not found errors don't open the breaker
+	assert.False(unavailable(errdefs.NotFound(errors.New("manifest unknown"))))
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheStats are the image digest lookups served by the cache, shared with a concurrent lookup of the same image or
+// sent to the registries.
+type CacheStats struct {
+	Hits    int64 `json:"hits"`
+	Shared  int64 `json:"shared"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+type digestEntry struct {
+	digest   digest.Digest
+	resolved time.Time
+	run      uint64
+}
+
+// digestCache keeps the digests resolved from the registries by image reference and credentials. The digests are
+// reused for the rest of the run that resolved them and, with a ttl, by the next runs.
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[string]digestEntry
+	group   singleflight.Group
+	runs    atomic.Uint64
+	hits    atomic.Int64
+	shared  atomic.Int64
+	misses  atomic.Int64
+}
+
+// newRun returns the id of a new run, the digests resolved by a run are always reused by it. The lookups outside of
+// a run use zero.
+func (d *digestCache) newRun() uint64 {
+	return d.runs.Add(1)
+}
+
+// digestCacheKey normalizes the reference, so nginx and docker.io/library/nginx:latest share the entry, and
+// hashes the credentials, as different accounts may see different images.
+func digestCacheKey(image, encodedAuth string) string {
+	key := image
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		key = reference.TagNameOnly(named).String()
+	}
+
+	auth := sha256.Sum256([]byte(encodedAuth))
+
+	return key + "|" + hex.EncodeToString(auth[:])
+}
+
+// resolve returns the digest of the image from the cache, or from inspect if it isn't cached. Concurrent lookups of
+// the same image and credentials share a single call, and the errors aren't cached.
+func (d *digestCache) resolve(ctx context.Context, run uint64, ttl time.Duration, image, encodedAuth string,
+	inspect func(ctx context.Context, image, encodedAuth string) (digest.Digest, error),
+) (digest.Digest, error) {
+	key := digestCacheKey(image, encodedAuth)
+
+	d.mu.Lock()
+	entry, ok := d.entries[key]
+	d.mu.Unlock()
+
+	if ok && ((run != 0 && entry.run == run) || (ttl > 0 && time.Since(entry.resolved) < ttl)) {
+		d.hits.Add(1)
+		return entry.digest, nil
+	}
+
+	executed := false
+	value, err, _ := d.group.Do(key, func() (any, error) {
+		executed = true
+		d.misses.Add(1)
+
+		dgst, err := inspect(ctx, image, encodedAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		d.store(key, digestEntry{digest: dgst, resolved: time.Now(), run: run}, ttl)
+
+		return dgst, nil
+	})
+
+	if !executed {
+		d.shared.Add(1)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return value.(digest.Digest), nil
+}
+
+// store saves the entry and forgets the ones that can't be used anymore.
+func (d *digestCache) store(key string, entry digestEntry, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.entries == nil {
+		d.entries = map[string]digestEntry{}
+	}
+
+	for other, old := range d.entries {
+		if old.run != entry.run && time.Since(old.resolved) >= ttl {
+			delete(d.entries, other)
+		}
+	}
+
+	d.entries[key] = entry
+}
+
+func (d *digestCache) stats() CacheStats {
+	d.mu.Lock()
+	entries := len(d.entries)
+	d.mu.Unlock()
+
+	return CacheStats{Hits: d.hits.Load(), Shared: d.shared.Load(), Misses: d.misses.Load(), Entries: entries}
+}
+
+// CacheStats returns the lookups of image digests served by the cache and sent to the registries.
+func (c *Swarm) CacheStats() CacheStats {
+	return c.digests.stats()
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestDigestCacheKey(t *testing.T) {
+	assert := test.New(t)
+
+	assert.Equal(digestCacheKey("nginx", ""), digestCacheKey("docker.io/library/nginx:latest", ""))
+	assert.NotEqual(digestCacheKey("nginx", ""), digestCacheKey("nginx:1.27", ""))
+	assert.NotEqual(digestCacheKey("nginx", ""), digestCacheKey("nginx", "e30K"))
+}
+
+func TestDigestCache(t *testing.T) {
+	assert := test.New(t)
+
+	services := func() []swarm.Service {
+		var services []swarm.Service
+		for i := range 5 {
+			service := swarm.Service{ID: fmt.Sprintf("web%d", i)}
+			service.Spec.Name = service.ID
+			service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "mycompany/web:latest"}
+			services = append(services, service)
+		}
+
+		return services
+	}
+
+	var inspects atomic.Int32
+	var fail atomic.Bool
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return services(), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		inspects.Add(1)
+		// give the other services time to wait for this lookup
+		time.Sleep(10 * time.Millisecond)
+
+		if fail.Load() {
+			return registry.DistributionInspect{}, errors.New("registry unavailable")
+		}
+
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 5}
+
+	run, err := s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Len(run.Services, 5)
+	assert.Equal(int32(1), inspects.Load())
+
+	stats := s.CacheStats()
+	assert.Equal(int64(1), stats.Misses)
+	assert.Equal(int64(4), stats.Hits+stats.Shared)
+	assert.Equal(1, stats.Entries)
+
+	// the digests aren't reused by the next run without a ttl
+	_, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(int32(2), inspects.Load())
+
+	s.DigestCacheTTL = time.Hour
+	_, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(int32(2), inspects.Load())
+	assert.Equal(int64(2), s.CacheStats().Misses)
+
+	// the errors aren't cached
+	s.DigestCacheTTL = 0
+	fail.Store(true)
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true, Services: []string{"web0"}})
+	assert.NoError(err)
+	assert.Equal(StatusFailed, run.Services[0].Status)
+
+	fail.Store(false)
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true, Services: []string{"web0"}})
+	assert.NoError(err)
+	assert.Equal(StatusOutdated, run.Services[0].Status)
+	assert.Equal(int32(4), inspects.Load())
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+const (
+	defaultCanarySoak   = 5 * time.Minute
+	defaultPollInterval = 5 * time.Second
+)
+
+// ErrCanaryFailed is returned when the canary replicas didn't survive the soak period.
+var ErrCanaryFailed = errors.New("canary failed")
+
+// canaryConfig returns the number of canary replicas and the soak period configured on the service labels.
+func canaryConfig(labels map[string]string) (uint64, time.Duration, error) {
+	value, ok := labels[canaryLabel]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	replicas, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s label: %w", canaryLabel, err)
+	}
+
+	soak := defaultCanarySoak
+	if value, ok := labels[canarySoakLabel]; ok {
+		soak, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s label: %w", canarySoakLabel, err)
+		}
+	}
+
+	return replicas, soak, nil
+}
+
+// canaryUpdateConfig patches the update config so swarm only rolls out the canary replicas and then waits for the
+// soak period, pausing the rollout if any of them fails while being monitored. The config is kept for the rest of the
+// rollout, as changing it again would replace the previous spec of the service with the new image.
+func canaryUpdateConfig(original *swarm.UpdateConfig, replicas uint64, soak time.Duration) *swarm.UpdateConfig {
+	updateConfig := swarm.UpdateConfig{}
+	if original != nil {
+		updateConfig = *original
+	}
+
+	updateConfig.Parallelism = replicas
+	updateConfig.Delay = soak
+	updateConfig.Monitor = soak
+	updateConfig.FailureAction = swarm.UpdateFailureActionPause
+
+	return &updateConfig
+}
+
+func (c *Swarm) pollEvery() time.Duration {
+	if c.pollInterval > 0 {
+		return c.pollInterval
+	}
+
+	return defaultPollInterval
+}
+
+// canaryHealth checks the tasks running the new image. Returns an error if any of them failed or if swarm paused
+// the rollout, otherwise reports if at least one of them is running.
+func (c *Swarm) canaryHealth(ctx context.Context, serviceID, image string) (bool, error) {
+	service, _, err := c.client.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return false, fmt.Errorf("ServiceInspect failed: %w", err)
+	}
+
+	if service.UpdateStatus != nil && service.UpdateStatus.State == swarm.UpdateStatePaused {
+		return false, fmt.Errorf("%w: rollout paused: %s", ErrCanaryFailed, service.UpdateStatus.Message)
+	}
+
+	tasks, err := c.client.TaskList(ctx, types.TaskListOptions{Filters: filters.NewArgs(filters.Arg("service", serviceID))})
+	if err != nil {
+		return false, fmt.Errorf("TaskList failed: %w", err)
+	}
+
+	running := false
+	for _, task := range tasks {
+		if task.Spec.ContainerSpec == nil || task.Spec.ContainerSpec.Image != image {
+			continue
+		}
+
+		switch task.Status.State {
+		case swarm.TaskStateFailed, swarm.TaskStateRejected:
+			return false, fmt.Errorf("%w: task %s is %s: %s", ErrCanaryFailed, task.ID, task.Status.State, task.Status.Err)
+		case swarm.TaskStateRunning:
+			running = true
+		}
+	}
+
+	return running, nil
+}
+
+// watchCanary waits for the soak period while checking the health of the canary replicas.
+func (c *Swarm) watchCanary(ctx context.Context, serviceID, image string, soak time.Duration) error {
+	ticker := time.NewTicker(c.pollEvery())
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(soak)
+
+	for {
+		running, err := c.canaryHealth(ctx, serviceID, image)
+		if err != nil {
+			return err
+		}
+
+		if !time.Now().Before(deadline) {
+			if !running {
+				return fmt.Errorf("%w: no canary replica running after %s", ErrCanaryFailed, soak)
+			}
+
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// runCanary watches the canary replicas after the service update was submitted. On success swarm continues with the
+// rest of the rollout by itself after the soak period, otherwise the service is rolled back to its previous spec,
+// with the old image and update config. A canary that is canceled during the soak period is rolled back too, even if
+// the context is done.
+func (c *Swarm) runCanary(ctx context.Context, service swarm.Service, soak time.Duration) error {
+	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	slog.Info("Watching canary replicas", "service", service.Spec.Name, "soak", soak)
+
+	watchErr := c.watchCanary(ctx, service.ID, image, soak)
+	if watchErr == nil {
+		slog.Info("Canary succeeded, swarm continues the rollout", "service", service.Spec.Name)
+
+		return nil
+	}
+
+	// the canary must be rolled back even if the run was canceled
+	ctx = context.WithoutCancel(ctx)
+
+	current, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("ServiceInspect failed: %w", err)
+	}
+
+	slog.Warn("Canary failed, rolling back service", "service", service.Spec.Name, "error", watchErr)
+
+	_, err = c.client.ServiceUpdate(ctx, service.ID, current.Version, current.Spec, types.ServiceUpdateOptions{Rollback: "previous"})
+	if err != nil {
+		return fmt.Errorf("failed to rollback service %s: %w", service.Spec.Name, err)
+	}
+
+	return watchErr
+}
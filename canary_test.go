@@ -0,0 +1,179 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+const newDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+func newCanaryMock(service *swarm.Service, taskState swarm.TaskState) (*dockerClientMock, *[]types.ServiceUpdateOptions) {
+	var updates []types.ServiceUpdateOptions
+
+	mock := &dockerClientMock{}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, _ string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return *service, nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, spec swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updates = append(updates, options)
+		// swarm keeps the replaced spec as the previous one, and a rollback restores it
+		if options.Rollback == "" {
+			previous := service.Spec
+			service.PreviousSpec, service.Spec = &previous, spec
+		} else {
+			service.PreviousSpec, service.Spec = nil, *service.PreviousSpec
+		}
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+	mock.TaskListFn = func(_ context.Context, _ types.TaskListOptions) ([]swarm.Task, error) {
+		task := swarm.Task{ID: "t1"}
+		task.Spec.ContainerSpec = &swarm.ContainerSpec{Image: service.Spec.TaskTemplate.ContainerSpec.Image}
+		task.Status.State = taskState
+
+		return []swarm.Task{task}, nil
+	}
+
+	return mock, &updates
+}
+
+func newCanaryService() *swarm.Service {
+	return &swarm.Service{
+		ID: "1",
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name:   "service_foo",
+				Labels: map[string]string{canaryLabel: "1", canarySoakLabel: "10ms"},
+			},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "foo:latest"}},
+			UpdateConfig: &swarm.UpdateConfig{Parallelism: 4, FailureAction: swarm.UpdateFailureActionContinue},
+		},
+		PreviousSpec: &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}},
+	}
+}
+
+func TestCanaryConfig(t *testing.T) {
+	assert := test.New(t)
+
+	replicas, _, err := canaryConfig(map[string]string{})
+	assert.NoError(err)
+	assert.Zero(replicas)
+
+	replicas, soak, err := canaryConfig(map[string]string{canaryLabel: "1", canarySoakLabel: "10m"})
+	assert.NoError(err)
+	assert.Equal(uint64(1), replicas)
+	assert.Equal(10*time.Minute, soak)
+
+	_, _, err = canaryConfig(map[string]string{canaryLabel: "one"})
+	assert.Error(err)
+}
+
+func TestCanarySuccess(t *testing.T) {
+	assert := test.New(t)
+
+	service := newCanaryService()
+	mock, updates := newCanaryMock(service, swarm.TaskStateRunning)
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	_, err := s.updateService(context.TODO(), *newCanaryService(), imageTarget{})
+	assert.NoError(err)
+
+	// swarm continues the rollout with the canary config, the previous spec keeps the old image
+	assert.Len(*updates, 1)
+	assert.Equal(uint64(1), service.Spec.UpdateConfig.Parallelism)
+	assert.Equal("foo:latest@"+newDigest, service.Spec.TaskTemplate.ContainerSpec.Image)
+	assert.Equal("foo:latest", service.PreviousSpec.TaskTemplate.ContainerSpec.Image)
+
+	result, err := s.Rollback(context.TODO(), service.ID, Caller{})
+	assert.NoError(err)
+	assert.Equal("foo:latest", result.Image)
+	assert.Equal("foo:latest", service.Spec.TaskTemplate.ContainerSpec.Image)
+	assert.Equal(uint64(4), service.Spec.UpdateConfig.Parallelism)
+}
+
+func TestCanaryRollback(t *testing.T) {
+	assert := test.New(t)
+
+	service := newCanaryService()
+	mock, updates := newCanaryMock(service, swarm.TaskStateFailed)
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	_, err := s.updateService(context.TODO(), *newCanaryService(), imageTarget{})
+	assert.ErrorIs(err, ErrCanaryFailed)
+
+	assert.Len(*updates, 2)
+	assert.Equal("previous", (*updates)[1].Rollback)
+	assert.Equal("foo:latest", service.Spec.TaskTemplate.ContainerSpec.Image)
+	assert.Equal(uint64(4), service.Spec.UpdateConfig.Parallelism)
+}
+
+func TestCanaryCanceled(t *testing.T) {
+	assert := test.New(t)
+
+	service := newCanaryService()
+	service.Spec.Labels[canarySoakLabel] = "1h"
+	mock, updates := newCanaryMock(service, swarm.TaskStateRunning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the docker client fails the calls after the context is done
+	inspect := mock.ServiceInspectWithRawFn
+	mock.ServiceInspectWithRawFn = func(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		if err := ctx.Err(); err != nil {
+			return swarm.Service{}, nil, err
+		}
+
+		return inspect(ctx, serviceID, opts)
+	}
+	update := mock.ServiceUpdateFn
+	mock.ServiceUpdateFn = func(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		if err := ctx.Err(); err != nil {
+			return swarm.ServiceUpdateResponse{}, err
+		}
+
+		return update(ctx, serviceID, version, spec, options)
+	}
+	taskList := mock.TaskListFn
+	mock.TaskListFn = func(ctx context.Context, opts types.TaskListOptions) ([]swarm.Task, error) {
+		// cancel the run while the canary is soaking
+		cancel()
+
+		return taskList(ctx, opts)
+	}
+
+	s := Swarm{client: mock, pollInterval: time.Millisecond}
+	_, err := s.updateService(ctx, *service, imageTarget{})
+	assert.ErrorIs(err, context.Canceled)
+
+	// the canary wasn't validated, so it's rolled back
+	assert.Len(*updates, 2)
+	assert.Equal("previous", (*updates)[1].Rollback)
+}
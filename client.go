@@ -20,7 +20,6 @@ import (
 	"context"
 
 	"github.com/docker/cli/cli/command"
-	"github.com/docker/cli/cli/config/configfile"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/api/types/swarm"
@@ -30,23 +29,35 @@ import (
 // DockerClient interacts with a Docker Swarm.
 type DockerClient interface {
 	DistributionInspect(ctx context.Context, image, encodedAuth string) (registry.DistributionInspect, error)
+	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
 	RetrieveAuthTokenFromImage(image string) (string, error)
+	ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (swarm.ServiceCreateResponse, error)
 	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error)
 	ServiceInspectWithRaw(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error)
 	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceRemove(ctx context.Context, serviceID string) error
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
 }
 
 type dockerClient struct {
-	apiClient  *client.Client
-	configFile *configfile.ConfigFile
+	apiClient *client.Client
+	config    *configLoader
 }
 
 func (c *dockerClient) DistributionInspect(ctx context.Context, image, encodedAuth string) (registry.DistributionInspect, error) {
 	return c.apiClient.DistributionInspect(ctx, image, encodedAuth)
 }
 
+func (c *dockerClient) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	return c.apiClient.NodeList(ctx, options)
+}
+
 func (c *dockerClient) RetrieveAuthTokenFromImage(image string) (string, error) {
-	return command.RetrieveAuthTokenFromImage(c.configFile, image)
+	return command.RetrieveAuthTokenFromImage(c.config.current(), image)
+}
+
+func (c *dockerClient) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (swarm.ServiceCreateResponse, error) {
+	return c.apiClient.ServiceCreate(ctx, service, options)
 }
 
 func (c *dockerClient) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
@@ -60,3 +71,11 @@ func (c *dockerClient) ServiceInspectWithRaw(ctx context.Context, serviceID stri
 func (c *dockerClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
 	return c.apiClient.ServiceList(ctx, options)
 }
+
+func (c *dockerClient) ServiceRemove(ctx context.Context, serviceID string) error {
+	return c.apiClient.ServiceRemove(ctx, serviceID)
+}
+
+func (c *dockerClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	return c.apiClient.TaskList(ctx, options)
+}
@@ -0,0 +1,418 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// exit codes of the commands, besides zero on success
+const (
+	exitError   = 1
+	exitUsage   = 2
+	exitPending = 3
+)
+
+// identity of the operations started from the command line
+const cliIdentity = "cli"
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var outputFlag = cli.StringFlag{
+	Name:  "output, o",
+	Usage: "output format, text or json",
+	Value: outputText,
+}
+
+var selectionFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "service",
+		Usage: "name or ID of a service to update",
+	},
+	cli.StringSliceFlag{
+		Name:  "image",
+		Usage: "image reference of the services to update, a tag on it only matches the services with that tag, a digest is deployed on the matched services",
+	},
+	cli.StringSliceFlag{
+		Name:  "stack",
+		Usage: "name of a stack with the services to update",
+	},
+	cli.StringFlag{
+		Name:  "label-selector",
+		Usage: "comma separated list of key, key=value or key!=value service label requirements",
+	},
+}
+
+// writeOutput writes the value as JSON, or calls the text function, depending on the output flag.
+func writeOutput(c *cli.Context, v any, text func(w io.Writer)) error {
+	switch c.String("output") {
+	case outputJSON:
+		encoder := json.NewEncoder(c.App.Writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case outputText, "":
+		text(c.App.Writer)
+		return nil
+	default:
+		return cli.NewExitError(fmt.Sprintf("invalid output format %q", c.String("output")), exitUsage)
+	}
+}
+
+func selectedServices(c *cli.Context) UpdateOptions {
+	return UpdateOptions{
+		Images:        c.StringSlice("image"),
+		Services:      c.StringSlice("service"),
+		Stacks:        c.StringSlice("stack"),
+		LabelSelector: c.String("label-selector"),
+		Caller:        Caller{Identity: cliIdentity},
+	}
+}
+
+func printResults(w io.Writer, result *RunResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "SERVICE\tSTATUS\tIMAGE\tDETAIL")
+
+	for _, service := range result.Services {
+		detail := service.Reason
+		if service.Error != "" {
+			detail = service.ErrorClass + ": " + service.Error
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", service.Service, service.Status, service.Image, detail)
+	}
+
+	_ = tw.Flush()
+}
+
+func printServices(w io.Writer, services []ServiceInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NAME\tMANAGED\tIMAGE\tREASON")
+
+	for _, service := range services {
+		reason := service.Reason
+		if service.PolicyError != "" {
+			reason = service.PolicyError
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%t\t%s\t%s\n", service.Name, service.Managed, service.Image, reason)
+	}
+
+	_ = tw.Flush()
+}
+
+func printHistory(w io.Writer, entries []HistoryEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TIME\tSERVICE\tACTION\tSTATUS\tIMAGE\tERROR")
+
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339),
+			entry.Service, entry.Action, entry.Status, entry.Image, entry.Error)
+	}
+
+	_ = tw.Flush()
+}
+
+// failedServices returns an exit error if any service failed to update.
+func failedServices(services []ServiceResult) error {
+	failed := 0
+	for _, service := range services {
+		if service.Status == StatusFailed {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d services failed to update", failed), exitError)
+	}
+
+	return nil
+}
+
+func check(c *cli.Context) error {
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	opts := selectedServices(c)
+	opts.DryRun = true
+
+	result, err := swarm.Update(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeOutput(c, result, func(w io.Writer) { printResults(w, result) }); err != nil {
+		return err
+	}
+
+	for _, service := range result.Services {
+		if service.Status == StatusOutdated {
+			return cli.NewExitError("", exitPending)
+		}
+	}
+
+	return nil
+}
+
+func update(c *cli.Context) error {
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	opts := selectedServices(c)
+	opts.Force = c.Bool("force")
+
+	result, err := swarm.Update(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeOutput(c, result, func(w io.Writer) { printResults(w, result) }); err != nil {
+		return err
+	}
+
+	return failedServices(result.Services)
+}
+
+func list(c *cli.Context) error {
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	services, err := swarm.Services(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, services, func(w io.Writer) { printServices(w, services) })
+}
+
+func rollback(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return cli.NewExitError("missing service name", exitUsage)
+	}
+
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := swarm.Rollback(context.Background(), name, Caller{Identity: cliIdentity})
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(c.App.Writer, "Rolled back %s to %s\n", result.Service, result.Image)
+
+	return nil
+}
+
+func history(c *cli.Context) error {
+	// a new process has nothing on the in-memory history
+	if c.GlobalString("data-dir") == "" {
+		return cli.NewExitError("the history is only saved with --data-dir", exitUsage)
+	}
+
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	entries, err := swarm.History(c.String("service"), c.Int("limit"))
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, entries, func(w io.Writer) { printHistory(w, entries) })
+}
+
+func explain(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return cli.NewExitError("missing service name", exitUsage)
+	}
+
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	explanation, err := swarm.Explain(context.Background(), name)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, explanation, func(w io.Writer) { explanation.Print(w) })
+}
+
+// ConfigValidation has the problems found on the updater configuration.
+type ConfigValidation struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func validateConfig(c *cli.Context) error {
+	validation := ConfigValidation{Errors: []string{}, Warnings: []string{}}
+
+	if schedule := c.GlobalString("schedule"); schedule != "none" {
+		if _, err := scheduleParser.Parse(schedule); err != nil {
+			validation.Errors = append(validation.Errors, fmt.Sprintf("invalid schedule %q: %s", schedule, err))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.GlobalString("listen")); err != nil {
+		validation.Errors = append(validation.Errors, fmt.Sprintf("invalid listen address: %s", err))
+	}
+
+	if _, err := newTLSConfig(tlsOptions(c)); err != nil {
+		validation.Errors = append(validation.Errors, err.Error())
+	}
+
+	if c.GlobalInt("max-threads") < 1 {
+		validation.Errors = append(validation.Errors, "max-threads must be at least 1")
+	}
+
+	if c.GlobalInt("rate-limit") < 0 {
+		validation.Errors = append(validation.Errors, "rate-limit cannot be negative")
+	}
+
+	if c.GlobalDuration("digest-cache-ttl") < 0 {
+		validation.Errors = append(validation.Errors, "digest-cache-ttl cannot be negative")
+	}
+
+	if c.GlobalInt("registry-concurrency") < 0 {
+		validation.Errors = append(validation.Errors, "registry-concurrency cannot be negative")
+	}
+
+	if c.GlobalInt("registry-quota-reserve") < 0 {
+		validation.Errors = append(validation.Errors, "registry-quota-reserve cannot be negative")
+	}
+
+	if _, err := newCredentialChain(CredentialOptions{Helpers: c.GlobalStringSlice("credential-helper")}); err != nil {
+		validation.Errors = append(validation.Errors, err.Error())
+	}
+
+	if c.GlobalDuration("credential-cache-ttl") < 0 {
+		validation.Errors = append(validation.Errors, "credential-cache-ttl cannot be negative")
+	}
+
+	if dir := c.GlobalString("credentials-dir"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			validation.Errors = append(validation.Errors, fmt.Sprintf("credentials-dir %q is not a directory", dir))
+		}
+	}
+
+	if _, err := parseMirrorRules(c.GlobalStringSlice("registry-mirror")); err != nil {
+		validation.Errors = append(validation.Errors, err.Error())
+	}
+
+	if policy := c.GlobalString("registry-mirror-spec"); policy != MirrorPolicyCanonical && policy != MirrorPolicyRewritten {
+		validation.Errors = append(validation.Errors, fmt.Sprintf("invalid registry-mirror-spec %q, expected canonical or rewritten", policy))
+	}
+
+	if c.GlobalInt("registry-failure-threshold") < 0 {
+		validation.Errors = append(validation.Errors, "registry-failure-threshold cannot be negative")
+	}
+
+	if c.GlobalInt("retry-attempts") < 1 {
+		validation.Errors = append(validation.Errors, "retry-attempts must be at least 1")
+	}
+
+	if c.GlobalDuration("retry-delay") < 0 || c.GlobalDuration("retry-max-delay") < 0 {
+		validation.Errors = append(validation.Errors, "retry-delay and retry-max-delay cannot be negative")
+	}
+
+	if c.GlobalDuration("debounce") < 0 {
+		validation.Errors = append(validation.Errors, "debounce cannot be negative")
+	}
+
+	if c.GlobalInt("min-ready-workers") < 0 {
+		validation.Errors = append(validation.Errors, "min-ready-workers cannot be negative")
+	}
+
+	if dataDir := c.GlobalString("data-dir"); dataDir != "" {
+		if info, err := os.Stat(dataDir); err == nil && !info.IsDir() {
+			validation.Errors = append(validation.Errors, fmt.Sprintf("data-dir %s is not a directory", dataDir))
+		}
+	}
+
+	if _, err := newAuthentication(context.Background(), c); err != nil {
+		validation.Errors = append(validation.Errors, err.Error())
+	}
+
+	if c.GlobalBool("label-enable") && len(blacklist) > 0 {
+		validation.Warnings = append(validation.Warnings, "the blacklist is ignored when label-enable is set")
+	}
+
+	if c.Bool("services") {
+		swarm, err := newSwarm(c)
+		if err != nil {
+			return err
+		}
+
+		services, err := swarm.Services(context.Background())
+		if err != nil {
+			return err
+		}
+
+		for _, service := range services {
+			if service.Managed && service.PolicyError != "" {
+				validation.Errors = append(validation.Errors, fmt.Sprintf("service %s: %s", service.Name, service.PolicyError))
+			}
+		}
+	}
+
+	validation.Valid = len(validation.Errors) == 0
+
+	err := writeOutput(c, validation, func(w io.Writer) {
+		for _, problem := range validation.Errors {
+			_, _ = fmt.Fprintf(w, "error: %s\n", problem)
+		}
+
+		for _, problem := range validation.Warnings {
+			_, _ = fmt.Fprintf(w, "warning: %s\n", problem)
+		}
+
+		if validation.Valid {
+			_, _ = fmt.Fprintln(w, "configuration is valid")
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if !validation.Valid {
+		return cli.NewExitError("", exitError)
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+// newDockerAPI returns the host of a docker daemon that lists the services and resolves every image to newDigest.
+func newDockerAPI(t *testing.T, services []swarm.Service) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "1.47")
+
+		switch {
+		case r.URL.Path == "/_ping":
+			_, _ = w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/services"):
+			_ = json.NewEncoder(w).Encode(services)
+		case strings.Contains(r.URL.Path, "/distribution/"):
+			_ = json.NewEncoder(w).Encode(registry.DistributionInspect{
+				Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return "tcp://" + strings.TrimPrefix(ts.URL, "http://")
+}
+
+// runApp runs the command line application and returns its output and exit code.
+func runApp(args ...string) (string, int) {
+	var out bytes.Buffer
+
+	app := newApp()
+	app.Writer = &out
+	app.ErrWriter = io.Discard
+	app.ExitErrHandler = func(_ *cli.Context, _ error) {}
+
+	err := app.Run(append([]string{"swarm-updater"}, args...))
+
+	var exitErr cli.ExitCoder
+	switch {
+	case errors.As(err, &exitErr):
+		return out.String(), exitErr.ExitCode()
+	case err != nil:
+		return out.String(), exitError
+	default:
+		return out.String(), 0
+	}
+}
+
+func TestCommands(t *testing.T) {
+	assert := test.New(t)
+
+	host := newDockerAPI(t, []swarm.Service{
+		{ID: "1", Spec: swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: "web"},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx:1.27"}},
+		}},
+		{ID: "2", Spec: swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: "cache"},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "redis:7@" + newDigest}},
+		}},
+	})
+	global := []string{"--host", host, "--config", t.TempDir(), "--allow-no-auth"}
+
+	tests := []struct {
+		args   []string
+		code   int
+		output string
+	}{
+		// check exits with 3 only if a selected service is outdated
+		{[]string{"check"}, exitPending, "web"},
+		{[]string{"check", "--image", "redis"}, 0, "up-to-date"},
+		{[]string{"check", "--output", "json"}, exitPending, `"status": "outdated"`},
+		{[]string{"check", "--output", "yaml"}, exitUsage, ""},
+		{[]string{"validate-config"}, 0, "configuration is valid"},
+		{[]string{"validate-config", "--output", "json"}, 0, `"valid": true`},
+		{[]string{"--max-threads", "0", "validate-config"}, exitError, "max-threads must be at least 1"},
+		{[]string{"--schedule", "every day", "validate-config", "--output", "json"}, exitError, `"valid": false`},
+		// a new process has no history without the data directory
+		{[]string{"history"}, exitUsage, ""},
+		{[]string{"--data-dir", t.TempDir(), "history", "--output", "json"}, 0, "[]"},
+	}
+
+	for _, tt := range tests {
+		args := append(append([]string{}, global...), tt.args...)
+		output, code := runApp(args...)
+		assert.Equal(tt.code, code, "%v: %s", tt.args, output)
+		assert.Contains(output, tt.output, "%v", tt.args)
+	}
+}
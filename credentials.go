@@ -0,0 +1,391 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/credentials"
+	helperclient "github.com/docker/docker-credential-helpers/client"
+	helpercredentials "github.com/docker/docker-credential-helpers/credentials"
+	"github.com/docker/docker/api/types/registry"
+)
+
+const (
+	credentialsEnvPrefix = "REGISTRY_AUTH_"
+	configReloadInterval = 10 * time.Second
+	helperTimeout        = 30 * time.Second
+	// dockerHubServer is the server address of docker.io on the config file and the credential helpers
+	dockerHubServer = "https://index.docker.io/v1/"
+	// helperTokenUsername is the username returned by the credential helpers for an identity token
+	helperTokenUsername = "<token>"
+)
+
+var (
+	ErrInvalidCredentialHelper = errors.New("invalid credential helper")
+	ErrInvalidCredentialName   = errors.New("invalid credential name")
+	ErrCredentialNotFound      = errors.New("registry credential not found")
+)
+
+// CredentialOptions configures the providers of registry credentials that are checked before the docker config file.
+type CredentialOptions struct {
+	// SecretsDir has a <registry>.json file with the credentials of each registry, like the mounted swarm secrets,
+	// and a <name>@<registry>.json file for every named credential
+	SecretsDir string
+	// Helpers are the credential helpers of the registries, like *.dkr.ecr.*.amazonaws.com=ecr-login
+	Helpers []string
+	// CacheTTL is how long the credentials returned by the helpers are reused
+	CacheTTL time.Duration
+}
+
+// credentialProvider returns the credentials of a registry domain, if it has them. The credential is the name of the
+// credential selected by the service, empty for the default one of the registry.
+type credentialProvider interface {
+	name() string
+	credentials(ctx context.Context, domain, credential string) (registry.AuthConfig, bool, error)
+}
+
+// credentialChain asks every provider in order for the credentials of a registry, the first one that has them wins.
+type credentialChain struct {
+	providers []credentialProvider
+}
+
+func newCredentialChain(opts CredentialOptions) (*credentialChain, error) {
+	chain := &credentialChain{providers: []credentialProvider{envCredentials{lookupEnv: os.LookupEnv}}}
+
+	if opts.SecretsDir != "" {
+		chain.providers = append(chain.providers, secretCredentials{dir: opts.SecretsDir})
+	}
+
+	for _, raw := range opts.Helpers {
+		helper, err := parseCredentialHelper(raw, opts.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		chain.providers = append(chain.providers, helper)
+	}
+
+	return chain, nil
+}
+
+func (c *credentialChain) lookup(ctx context.Context, domain, credential string) (registry.AuthConfig, bool, error) {
+	for _, provider := range c.providers {
+		auth, ok, err := provider.credentials(ctx, domain, credential)
+		if err != nil {
+			return registry.AuthConfig{}, false, fmt.Errorf("%s credentials of %s: %w", provider.name(), domain, err)
+		}
+
+		if ok {
+			slog.Debug("Using registry credentials", "registry", domain, "provider", provider.name(),
+				"credential", credential)
+			return auth, true, nil
+		}
+	}
+
+	return registry.AuthConfig{}, false, nil
+}
+
+// validateCredentialName checks the name of a credential selected by a service label, it's used in file and
+// environment variable names.
+func validateCredentialName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: the name is empty", ErrInvalidCredentialName)
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return fmt.Errorf("%w: %q, only letters, digits, - and _ are allowed", ErrInvalidCredentialName, name)
+		}
+	}
+
+	return nil
+}
+
+// serverAddress returns the address of the registry used by the config file and the credential helpers.
+func serverAddress(domain string) string {
+	if domain == dockerHubDomain {
+		return dockerHubServer
+	}
+
+	return domain
+}
+
+// envCredentials reads the credentials from REGISTRY_AUTH_<DOMAIN>_USERNAME and REGISTRY_AUTH_<DOMAIN>_PASSWORD,
+// where the domain is in upper case with the other characters replaced by underscores, like GHCR_IO. The named
+// credentials use REGISTRY_AUTH_<DOMAIN>__<NAME>_USERNAME and REGISTRY_AUTH_<DOMAIN>__<NAME>_PASSWORD.
+type envCredentials struct {
+	lookupEnv func(key string) (string, bool)
+}
+
+func credentialsEnvName(domain, credential, suffix string) string {
+	upper := func(value string) string {
+		return strings.ToUpper(strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, value))
+	}
+
+	name := upper(domain)
+	if credential != "" {
+		name += "__" + upper(credential)
+	}
+
+	return credentialsEnvPrefix + name + "_" + suffix
+}
+
+func (e envCredentials) name() string {
+	return "env"
+}
+
+func (e envCredentials) credentials(_ context.Context, domain, credential string) (registry.AuthConfig, bool, error) {
+	username, ok := e.lookupEnv(credentialsEnvName(domain, credential, "USERNAME"))
+	if !ok || username == "" {
+		return registry.AuthConfig{}, false, nil
+	}
+
+	password, _ := e.lookupEnv(credentialsEnvName(domain, credential, "PASSWORD"))
+
+	return registry.AuthConfig{Username: username, Password: password, ServerAddress: serverAddress(domain)}, true, nil
+}
+
+// secretCredentials reads the credentials from a <domain>.json file, with the username and password or the
+// identitytoken of the registry, or a <name>@<domain>.json file for a named credential. The files are read on every
+// lookup, so a rotated secret is used right away.
+type secretCredentials struct {
+	dir string
+}
+
+func (s secretCredentials) name() string {
+	return "secret"
+}
+
+func (s secretCredentials) credentials(_ context.Context, domain, credential string) (registry.AuthConfig, bool, error) {
+	if domain == "" || strings.ContainsAny(domain+credential, `/\`) {
+		return registry.AuthConfig{}, false, nil
+	}
+
+	file := domain + ".json"
+	if credential != "" {
+		file = credential + "@" + file
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, file))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return registry.AuthConfig{}, false, nil
+		}
+		return registry.AuthConfig{}, false, err
+	}
+
+	var auth registry.AuthConfig
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return registry.AuthConfig{}, false, fmt.Errorf("cannot parse %s: %w", file, err)
+	}
+
+	if auth.Username == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return registry.AuthConfig{}, false, fmt.Errorf("%s has no username or token", file)
+	}
+
+	auth.ServerAddress = serverAddress(domain)
+
+	return auth, true, nil
+}
+
+type cachedCredentials struct {
+	auth    registry.AuthConfig
+	expires time.Time
+}
+
+// helperCredentials runs a docker credential helper for the registries that match its pattern, and reuses the
+// credentials during the cache ttl, as the helpers of the cloud registries usually request a new token every time.
+// A helper has a single account per registry, so it doesn't have named credentials.
+type helperCredentials struct {
+	pattern string
+	program string
+	ttl     time.Duration
+	mu      sync.Mutex
+	cache   map[string]cachedCredentials
+}
+
+// parseCredentialHelper parses a pattern=helper pair. The helper is the suffix of a docker-credential-<helper>
+// program, or the path of the program.
+func parseCredentialHelper(raw string, ttl time.Duration) (*helperCredentials, error) {
+	pattern, helper, found := strings.Cut(raw, "=")
+	pattern = strings.TrimSpace(pattern)
+	helper = strings.TrimSpace(helper)
+
+	if !found || pattern == "" || helper == "" {
+		return nil, fmt.Errorf("%w: %q, expected a pair like *.dkr.ecr.*.amazonaws.com=ecr-login",
+			ErrInvalidCredentialHelper, raw)
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrInvalidCredentialHelper, raw, err)
+	}
+
+	program := helper
+	if !strings.ContainsRune(helper, '/') {
+		program = "docker-credential-" + helper
+	}
+
+	return &helperCredentials{pattern: pattern, program: program, ttl: ttl}, nil
+}
+
+func (h *helperCredentials) name() string {
+	return "helper " + h.program
+}
+
+func (h *helperCredentials) credentials(ctx context.Context, domain, credential string) (registry.AuthConfig, bool, error) {
+	if ok, _ := path.Match(h.pattern, domain); !ok || credential != "" {
+		return registry.AuthConfig{}, false, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cached, ok := h.cache[domain]; ok && time.Now().Before(cached.expires) {
+		return cached.auth, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+
+	creds, err := helperclient.Get(func(args ...string) helperclient.Program {
+		return &helperProgram{cmd: exec.CommandContext(ctx, h.program, args...)}
+	}, serverAddress(domain))
+	if err != nil {
+		if helpercredentials.IsErrCredentialsNotFound(err) {
+			return registry.AuthConfig{}, false, nil
+		}
+		return registry.AuthConfig{}, false, err
+	}
+
+	auth := registry.AuthConfig{ServerAddress: serverAddress(domain)}
+	if creds.Username == helperTokenUsername {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username = creds.Username
+		auth.Password = creds.Secret
+	}
+
+	if h.ttl > 0 {
+		if h.cache == nil {
+			h.cache = map[string]cachedCredentials{}
+		}
+		h.cache[domain] = cachedCredentials{auth: auth, expires: time.Now().Add(h.ttl)}
+	}
+
+	return auth, true, nil
+}
+
+// helperProgram runs a credential helper, it's killed if the context is done.
+type helperProgram struct {
+	cmd *exec.Cmd
+}
+
+func (p *helperProgram) Output() ([]byte, error) {
+	return p.cmd.Output()
+}
+
+func (p *helperProgram) Input(in io.Reader) {
+	p.cmd.Stdin = in
+}
+
+// configLoader keeps the docker config file, and loads it again when it changes, so the rotated credentials are used
+// without restarting the updater.
+type configLoader struct {
+	dir     string
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	file    *configfile.ConfigFile
+}
+
+func newConfigLoader(dir string) *configLoader {
+	l := &configLoader{dir: dir, checked: time.Now()}
+	l.load()
+
+	return l
+}
+
+func (l *configLoader) path() string {
+	dir := l.dir
+	if dir == "" {
+		dir = config.Dir()
+	}
+
+	return filepath.Join(dir, config.ConfigFileName)
+}
+
+// modified returns the modification time of the config file, zero if it doesn't exist.
+func (l *configLoader) modified() time.Time {
+	info, err := os.Stat(l.path())
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+func (l *configLoader) load() {
+	l.modTime = l.modified()
+
+	configFile, err := config.Load(l.dir)
+	if err != nil {
+		// https://github.com/docker/cli/issues/5075
+		slog.Warn("failed to load config", "err", err)
+	}
+
+	if !configFile.ContainsAuth() {
+		configFile.CredentialsStore = credentials.DetectDefaultStore(configFile.CredentialsStore)
+	}
+
+	l.file = configFile
+}
+
+// current returns the config file, loading it again if it changed.
+func (l *configLoader) current() *configfile.ConfigFile {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.checked) >= configReloadInterval {
+		l.checked = time.Now()
+
+		if !l.modified().Equal(l.modTime) {
+			l.load()
+			slog.Info("Reloaded the docker config file", "path", l.path())
+		}
+	}
+
+	return l.file
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+// writeCredentialHelper writes a credential helper that returns a token for every registry but missing.local, and
+// logs the registries that it was called with.
+func writeCredentialHelper(t *testing.T) (string, func() []string) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	helper := filepath.Join(dir, "docker-credential-test")
+
+	script := `#!/bin/sh
+read server
+echo "$server" >> "` + calls + `"
+if [ "$server" = "missing.local" ]; then
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+printf '{"ServerURL":"%s","Username":"<token>","Secret":"token-for-%s"}' "$server" "$server"
+`
+	if err := os.WriteFile(helper, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	return helper, func() []string {
+		data, _ := os.ReadFile(calls)
+		return strings.Fields(string(data))
+	}
+}
+
+func TestCredentialChain(t *testing.T) {
+	assert := test.New(t)
+
+	helper, calls := writeCredentialHelper(t)
+	secrets := t.TempDir()
+
+	assert.NoError(os.WriteFile(filepath.Join(secrets, "ghcr.io.json"), []byte(`{"username":"bot","password":"file"}`), 0o600))
+	assert.NoError(os.WriteFile(filepath.Join(secrets, "registry.local.json"), []byte(`{"username":"bot","password":"file"}`), 0o600))
+	assert.NoError(os.WriteFile(filepath.Join(secrets, "broken.local.json"), []byte(`{`), 0o600))
+	t.Setenv("REGISTRY_AUTH_REGISTRY_LOCAL_USERNAME", "ci")
+	t.Setenv("REGISTRY_AUTH_REGISTRY_LOCAL_PASSWORD", "env")
+
+	chain, err := newCredentialChain(CredentialOptions{
+		SecretsDir: secrets,
+		Helpers:    []string{"*.local=" + helper},
+		CacheTTL:   time.Hour,
+	})
+	assert.NoError(err)
+
+	lookup := func(domain string) (registry.AuthConfig, bool) {
+		auth, ok, err := chain.lookup(context.TODO(), domain, "")
+		assert.NoError(err)
+
+		return auth, ok
+	}
+
+	// the environment variables go first
+	auth, ok := lookup("registry.local")
+	assert.True(ok)
+	assert.Equal("ci", auth.Username)
+	assert.Equal("env", auth.Password)
+
+	auth, ok = lookup("ghcr.io")
+	assert.True(ok)
+	assert.Equal("file", auth.Password)
+	assert.Equal("ghcr.io", auth.ServerAddress)
+
+	// the helper tokens are cached
+	auth, ok = lookup("cloud.local")
+	assert.True(ok)
+	assert.Equal("token-for-cloud.local", auth.IdentityToken)
+	_, _ = lookup("cloud.local")
+	assert.Equal([]string{"cloud.local"}, calls())
+
+	_, ok = lookup("missing.local")
+	assert.False(ok)
+
+	_, ok = lookup("docker.io")
+	assert.False(ok)
+
+	_, _, err = chain.lookup(context.TODO(), "broken.local", "")
+	assert.Error(err)
+
+	_, err = newCredentialChain(CredentialOptions{Helpers: []string{"ecr-login"}})
+	assert.ErrorIs(err, ErrInvalidCredentialHelper)
+
+	assert.Equal("REGISTRY_AUTH_DOCKER_IO_USERNAME", credentialsEnvName("docker.io", "", "USERNAME"))
+	assert.Equal("REGISTRY_AUTH_LOCALHOST_5000_PASSWORD", credentialsEnvName("localhost:5000", "", "PASSWORD"))
+}
+
+func TestRegistryAuthProviders(t *testing.T) {
+	assert := test.New(t)
+
+	t.Setenv("REGISTRY_AUTH_GHCR_IO_USERNAME", "ci")
+	t.Setenv("REGISTRY_AUTH_GHCR_IO_PASSWORD", "secret")
+
+	chain, err := newCredentialChain(CredentialOptions{})
+	assert.NoError(err)
+
+	mock := dockerClientMock{}
+	mock.RetrieveAuthTokenFromImageFn = func(_ string) (string, error) {
+		return "config-auth", nil
+	}
+
+	s := &Swarm{client: &mock, credentials: chain}
+
+	encoded, err := s.registryAuth(context.TODO(), "ghcr.io/mycompany/web:1.0", "")
+	assert.NoError(err)
+
+	auth, err := registry.DecodeAuthConfig(encoded)
+	assert.NoError(err)
+	assert.Equal("ci", auth.Username)
+	assert.Equal("secret", auth.Password)
+
+	// the config file is used for the other registries
+	encoded, err = s.registryAuth(context.TODO(), "mycompany/web:1.0", "")
+	assert.NoError(err)
+	assert.Equal("config-auth", encoded)
+}
+
+func TestNamedCredentials(t *testing.T) {
+	assert := test.New(t)
+
+	helper, calls := writeCredentialHelper(t)
+	secrets := t.TempDir()
+
+	assert.NoError(os.WriteFile(filepath.Join(secrets, "ghcr.io.json"), []byte(`{"username":"bot","password":"default"}`), 0o600))
+	assert.NoError(os.WriteFile(filepath.Join(secrets, "teamA@ghcr.io.json"), []byte(`{"username":"team-a","password":"file"}`), 0o600))
+	t.Setenv("REGISTRY_AUTH_REGISTRY_LOCAL__TEAM_B_USERNAME", "team-b")
+	t.Setenv("REGISTRY_AUTH_REGISTRY_LOCAL__TEAM_B_PASSWORD", "env")
+
+	chain, err := newCredentialChain(CredentialOptions{SecretsDir: secrets, Helpers: []string{"*.local=" + helper}})
+	assert.NoError(err)
+
+	auth, ok, err := chain.lookup(context.TODO(), "ghcr.io", "teamA")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("team-a", auth.Username)
+	assert.Equal("ghcr.io", auth.ServerAddress)
+
+	auth, ok, err = chain.lookup(context.TODO(), "registry.local", "team-b")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("team-b", auth.Username)
+	assert.Equal("env", auth.Password)
+
+	// the helpers don't have named credentials
+	_, ok, err = chain.lookup(context.TODO(), "cloud.local", "teamA")
+	assert.NoError(err)
+	assert.False(ok)
+	assert.Empty(calls())
+
+	assert.Equal("REGISTRY_AUTH_GHCR_IO__TEAM_A_USERNAME", credentialsEnvName("ghcr.io", "team-a", "USERNAME"))
+
+	assert.NoError(validateCredentialName("team_A-1"))
+	assert.ErrorIs(validateCredentialName("../teamA"), ErrInvalidCredentialName)
+	assert.ErrorIs(validateCredentialName(""), ErrInvalidCredentialName)
+}
+
+func TestServiceCredentialLabel(t *testing.T) {
+	assert := test.New(t)
+
+	secrets := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(secrets, "teamA@ghcr.io.json"), []byte(`{"username":"team-a","password":"secret"}`), 0o600))
+	t.Setenv("REGISTRY_AUTH_GHCR_IO_USERNAME", "ci")
+	t.Setenv("REGISTRY_AUTH_GHCR_IO_PASSWORD", "default")
+
+	chain, err := newCredentialChain(CredentialOptions{SecretsDir: secrets})
+	assert.NoError(err)
+
+	newService := func(name, credential string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "ghcr.io/mycompany/" + name + ":latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+		if credential != "" {
+			service.Spec.Labels = map[string]string{credentialLabel: credential}
+		}
+
+		return service
+	}
+
+	username := func(encodedAuth string) string {
+		auth, err := registry.DecodeAuthConfig(encodedAuth)
+		assert.NoError(err)
+
+		return auth.Username
+	}
+
+	var mu sync.Mutex
+	resolved := map[string]string{}
+	updated := map[string]string{}
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{newService("web", "teamA"), newService("api", ""), newService("worker", "teamB")}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, image, encodedAuth string) (registry.DistributionInspect, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		name, _, _ := strings.Cut(image, ":")
+		resolved[name] = username(encodedAuth)
+
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return newService(serviceID, ""), nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, _ swarm.ServiceSpec, opts types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		updated[serviceID] = username(opts.EncodedRegistryAuth)
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1, credentials: chain}
+
+	run, err := s.Update(context.TODO(), UpdateOptions{})
+	assert.NoError(err)
+
+	results := map[string]ServiceResult{}
+	for _, result := range run.Services {
+		results[result.Service] = result
+	}
+
+	assert.Equal(StatusUpdated, results["web"].Status)
+	assert.Equal(StatusUpdated, results["api"].Status)
+	assert.Equal(map[string]string{"ghcr.io/mycompany/web": "team-a", "ghcr.io/mycompany/api": "ci"}, resolved)
+	assert.Equal(map[string]string{"web": "team-a", "api": "ci"}, updated)
+
+	// a missing named credential fails instead of using the default one
+	assert.Equal(StatusFailed, results["worker"].Status)
+	assert.Equal(ErrorAuth, results["worker"].ErrorClass)
+	assert.Contains(results["worker"].Error, "teamB")
+}
+
+func TestConfigReload(t *testing.T) {
+	assert := test.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	write := func(auth string, modified time.Time) {
+		assert.NoError(os.WriteFile(path, []byte(`{"auths":{"registry.local":{"auth":"`+auth+`"}}}`), 0o600))
+		assert.NoError(os.Chtimes(path, modified, modified))
+	}
+
+	// user:old and user:new
+	write("dXNlcjpvbGQ=", time.Now().Add(-time.Hour))
+
+	loader := newConfigLoader(dir)
+	auth, err := loader.current().GetAuthConfig("registry.local")
+	assert.NoError(err)
+	assert.Equal("old", auth.Password)
+
+	write("dXNlcjpuZXc=", time.Now())
+
+	// the file isn't checked again until the reload interval passes
+	auth, _ = loader.current().GetAuthConfig("registry.local")
+	assert.Equal("old", auth.Password)
+
+	loader.checked = time.Now().Add(-configReloadInterval)
+	auth, err = loader.current().GetAuthConfig("registry.local")
+	assert.NoError(err)
+	assert.Equal("new", auth.Password)
+}
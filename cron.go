@@ -22,32 +22,22 @@ import (
 	"github.com/robfig/cron/v3"
 )
 
+// scheduleParser accepts cron expressions with optional seconds and descriptors like @every 1h.
+var scheduleParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
 // CronService holds the instantiated cron service.
 type CronService struct {
 	cronService *cron.Cron
-	tryLockSem  chan bool
 }
 
-// NewCronService creates a new cron for the specified function.
+// NewCronService creates a new cron for the specified function. The function should only queue the work, so the
+// runs that take longer than the schedule are handled by the queue.
 func NewCronService(schedule string, cronFunc func()) (*CronService, error) {
-	cronService := cron.New(cron.WithParser(cron.NewParser(
-		cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
-	)))
+	cronService := cron.New(cron.WithParser(scheduleParser))
 
-	tryLockSem := make(chan bool, 1)
-	tryLockSem <- true
-
-	_, err := cronService.AddFunc(
-		schedule,
-		func() {
-			select {
-			case v := <-tryLockSem:
-				defer func() { tryLockSem <- v }()
-				cronFunc()
-			default:
-				slog.Debug("Skipping cron schedule. Already running")
-			}
-		})
+	_, err := cronService.AddFunc(schedule, cronFunc)
 	if err != nil {
 		return nil, err
 	}
@@ -56,7 +46,6 @@ func NewCronService(schedule string, cronFunc func()) (*CronService, error) {
 
 	return &CronService{
 		cronService: cronService,
-		tryLockSem:  tryLockSem,
 	}, nil
 }
 
@@ -69,7 +58,4 @@ func (c *CronService) Start() {
 func (c *CronService) Stop() {
 	ctx := c.cronService.Stop()
 	<-ctx.Done()
-
-	slog.Info("Waiting for running update to be finished...")
-	<-c.tryLockSem
 }
@@ -0,0 +1,175 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkInfo = "info"
+)
+
+// ExplainStep is a single check evaluated for a service.
+type ExplainStep struct {
+	Check  string `json:"check"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Explanation is the chain of decisions that the updater takes for a service.
+type Explanation struct {
+	Service       string        `json:"service"`
+	Stack         string        `json:"stack,omitempty"`
+	Image         string        `json:"image"`
+	ResolvedImage string        `json:"resolvedImage,omitempty"`
+	WouldUpdate   bool          `json:"wouldUpdate"`
+	Steps         []ExplainStep `json:"steps"`
+}
+
+func (e *Explanation) step(check, result, format string, args ...any) {
+	e.Steps = append(e.Steps, ExplainStep{Check: check, Result: result, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Explain evaluates every filter and policy of the service, and resolves its image digest, without updating it.
+func (c *Swarm) Explain(ctx context.Context, name string) (*Explanation, error) {
+	service, _, err := c.client.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot inspect service %s: %w", name, err)
+	}
+
+	explanation := &Explanation{
+		Service: service.Spec.Name,
+		Stack:   service.Spec.Labels[stackNamespaceLabel],
+		Image:   service.Spec.TaskTemplate.ContainerSpec.Image,
+		Steps:   []ExplainStep{},
+	}
+
+	if c.LabelEnable {
+		if valid, reason := c.serviceDecision(service); valid {
+			explanation.step("label-enable", checkPass, "%s label is set to true", enabledServiceLabel)
+		} else {
+			explanation.step("label-enable", checkFail, "%s", reason)
+			return explanation, nil
+		}
+	} else {
+		explanation.step("label-enable", checkInfo, "disabled, every service is watched")
+
+		if valid, reason := c.serviceDecision(service); valid {
+			explanation.step("blacklist", checkPass, "no rule matches the service name (%d rules)", len(c.Blacklist))
+		} else {
+			explanation.step("blacklist", checkFail, "matched by %s", reason)
+			return explanation, nil
+		}
+	}
+
+	if _, ok := service.Spec.Labels[serviceLabel]; ok {
+		explanation.step("self", checkInfo, "the updater service is updated after every other service")
+	}
+
+	if c.Preflight {
+		if err := c.preflight(ctx); err != nil {
+			explanation.step("preflight", checkFail, "%s", err)
+			return explanation, nil
+		}
+		explanation.step("preflight", checkPass, "the swarm is healthy")
+
+		if updateInProgress(service) {
+			explanation.step("update-in-progress", checkFail, "service state is %s", service.UpdateStatus.State)
+			return explanation, nil
+		}
+		explanation.step("update-in-progress", checkPass, "no update or rollback in progress")
+	} else {
+		explanation.step("preflight", checkInfo, "disabled")
+	}
+
+	policy, err := servicePolicy(service.Spec)
+	if err != nil {
+		explanation.step("policy", checkFail, "%s", err)
+		return explanation, nil
+	}
+	explanation.step("policy", checkPass, "%s", describePolicy(policy))
+
+	resolved, _, err := c.resolveImage(ctx, explanation.Image, imageTarget{credential: policy.Credential})
+	if err != nil {
+		explanation.step("registry", checkFail, "%s", err)
+		return explanation, nil
+	}
+	explanation.ResolvedImage = resolved
+	explanation.step("registry", checkPass, "resolved %s", resolved)
+
+	if resolved == explanation.Image {
+		explanation.step("digest", checkInfo, "the service already runs the latest digest")
+	} else {
+		explanation.WouldUpdate = true
+		explanation.step("digest", checkPass, "the service would be updated to %s", imageDigest(resolved))
+	}
+
+	return explanation, nil
+}
+
+// describePolicy returns a short summary of the service policy.
+func describePolicy(policy ServicePolicy) string {
+	parts := []string{"strategy " + policy.Strategy}
+
+	if policy.UpdateOnly {
+		parts = append(parts, "update only")
+	}
+
+	if policy.CanaryReplicas > 0 {
+		parts = append(parts, fmt.Sprintf("canary %d replicas for %s", policy.CanaryReplicas, policy.CanarySoak))
+	}
+
+	if policy.Strategy == strategyBlueGreen {
+		parts = append(parts, fmt.Sprintf("old service %s after %s", policy.BlueGreenOld, policy.BlueGreenTimeout))
+	}
+
+	if policy.Credential != "" {
+		parts = append(parts, "credential "+policy.Credential)
+	}
+
+	if policy.UpdateConfig != nil {
+		parts = append(parts, fmt.Sprintf("parallelism %d, delay %s, order %q, failure action %q",
+			policy.UpdateConfig.Parallelism, policy.UpdateConfig.Delay,
+			policy.UpdateConfig.Order, policy.UpdateConfig.FailureAction))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Print writes the explanation in a human readable format.
+func (e *Explanation) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Service: %s\n", e.Service)
+	_, _ = fmt.Fprintf(w, "Image:   %s\n", e.Image)
+
+	for _, step := range e.Steps {
+		_, _ = fmt.Fprintf(w, "  [%s] %s: %s\n", step.Result, step.Check, step.Detail)
+	}
+
+	if e.WouldUpdate {
+		_, _ = fmt.Fprintf(w, "Decision: would update to %s\n", e.ResolvedImage)
+	} else {
+		_, _ = fmt.Fprintln(w, "Decision: would not update")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		service := swarm.Service{ID: serviceID}
+		service.Spec.Name = serviceID
+		service.Spec.Labels = map[string]string{canaryLabel: "2"}
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest@sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+
+		return service, nil, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+
+	s := Swarm{client: &mock, Blacklist: []*regexp.Regexp{regexp.MustCompile("^db$")}}
+
+	explanation, err := s.Explain(context.TODO(), "web")
+	assert.NoError(err)
+	assert.True(explanation.WouldUpdate)
+	assert.Equal("foo:latest@"+newDigest, explanation.ResolvedImage)
+	assert.Equal("digest", explanation.Steps[len(explanation.Steps)-1].Check)
+	assert.Contains(explanation.Steps[len(explanation.Steps)-3].Detail, "canary 2 replicas")
+
+	var out bytes.Buffer
+	explanation.Print(&out)
+	assert.Contains(out.String(), "Decision: would update to foo:latest@"+newDigest)
+
+	explanation, err = s.Explain(context.TODO(), "db")
+	assert.NoError(err)
+	assert.False(explanation.WouldUpdate)
+	assert.Equal(ExplainStep{Check: "blacklist", Result: checkFail, Detail: `matched by blacklist rule "^db$"`},
+		explanation.Steps[len(explanation.Steps)-1])
+
+	s.LabelEnable = true
+	explanation, err = s.Explain(context.TODO(), "web")
+	assert.NoError(err)
+	assert.False(explanation.WouldUpdate)
+	assert.Len(explanation.Steps, 1)
+	assert.Equal(checkFail, explanation.Steps[0].Result)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	historyFile    = "history.jsonl"
+	actionUpdate   = "update"
+	actionRollback = "rollback"
+)
+
+// HistoryEntry is an update or rollback done by the updater on a service.
+type HistoryEntry struct {
+	Time          time.Time `json:"time"`
+	Service       string    `json:"service"`
+	Stack         string    `json:"stack,omitempty"`
+	Action        string    `json:"action"`
+	Status        string    `json:"status"`
+	Image         string    `json:"image,omitempty"`
+	PreviousImage string    `json:"previousImage,omitempty"`
+	Identity      string    `json:"identity,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	ErrorClass    string    `json:"errorClass,omitempty"`
+}
+
+// historyStore keeps the history in memory, or appends it to a file when a path is set.
+type historyStore struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+}
+
+func (h *historyStore) add(path string, entries []HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if path == "" {
+		h.entries = append(h.entries, entries...)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("cannot create the data directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("cannot open the history file: %w", err)
+	}
+
+	encoder := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("cannot write the history file: %w", err)
+		}
+	}
+
+	return f.Close()
+}
+
+func (h *historyStore) list(path string) ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if path == "" {
+		return slices.Clone(h.entries), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot open the history file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("cannot parse the history file: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read the history file: %w", err)
+	}
+
+	return entries, nil
+}
+
+func (c *Swarm) historyPath() string {
+	if c.DataDir == "" {
+		return ""
+	}
+
+	return filepath.Join(c.DataDir, historyFile)
+}
+
+// recordHistory saves the services that were changed, or failed to change, by the action of the caller.
+func (c *Swarm) recordHistory(action, identity string, results ...ServiceResult) {
+	now := time.Now()
+
+	var entries []HistoryEntry
+	for _, result := range results {
+		if result.Status != StatusUpdated && result.Status != StatusFailed {
+			continue
+		}
+
+		entries = append(entries, HistoryEntry{
+			Time:          now,
+			Service:       result.Service,
+			Stack:         result.Stack,
+			Action:        action,
+			Status:        result.Status,
+			Image:         result.Image,
+			PreviousImage: result.PreviousImage,
+			Error:         result.Error,
+			ErrorClass:    result.ErrorClass,
+			Identity:      identity,
+		})
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	if err := c.history.add(c.historyPath(), entries); err != nil {
+		slog.Error("Cannot save the update history", "error", err.Error())
+	}
+}
+
+// History returns the updates and rollbacks of the service, or of every service if empty, the newest first.
+// A limit of zero returns every entry.
+func (c *Swarm) History(service string, limit int) ([]HistoryEntry, error) {
+	return c.allowedHistory(service, limit, nil)
+}
+
+// allowedHistory returns the history like History, with only the entries of the services allowed by the access rule.
+func (c *Swarm) allowedHistory(service string, limit int, access *AccessRule) ([]HistoryEntry, error) {
+	entries, err := c.history.list(c.historyPath())
+	if err != nil {
+		return nil, err
+	}
+
+	result := []HistoryEntry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if service != "" && entries[i].Service != service {
+			continue
+		}
+
+		if !access.allows(entries[i].Service, entries[i].Stack, entries[i].Image) {
+			continue
+		}
+
+		result = append(result, entries[i])
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+
+	return result, nil
+}
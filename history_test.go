@@ -0,0 +1,96 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func() swarm.Service {
+		service := swarm.Service{ID: "1"}
+		service.Spec.Name = "service_foo"
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	updates := 0
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{newService()}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, _ string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return newService(), nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updates++
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	dataDir := t.TempDir()
+	s := Swarm{client: &mock, MaxThreads: 1, DataDir: dataDir}
+
+	result, err := s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(0, updates)
+	assert.Equal(StatusOutdated, result.Services[0].Status)
+	assert.Equal("foo:latest@"+newDigest, result.Services[0].Image)
+
+	entries, err := s.History("", 0)
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	for i := 0; i < 2; i++ {
+		_, err = s.Update(context.TODO(), UpdateOptions{})
+		assert.NoError(err)
+	}
+	assert.Equal(2, updates)
+
+	// the history is read back from the data directory
+	s = Swarm{client: &mock, DataDir: dataDir}
+	entries, err = s.History("service_foo", 0)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+	assert.Equal(actionUpdate, entries[0].Action)
+	assert.Equal(StatusUpdated, entries[0].Status)
+	assert.Equal("foo:latest", entries[0].PreviousImage)
+	assert.Equal("foo:latest@"+newDigest, entries[0].Image)
+
+	entries, err = s.History("", 1)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+
+	entries, err = s.History("service_bar", 0)
+	assert.NoError(err)
+	assert.Empty(entries)
+}
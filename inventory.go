@@ -0,0 +1,160 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// ServiceInfo describes a service seen by the updater and its update state.
+type ServiceInfo struct {
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	Stack        string         `json:"stack,omitempty"`
+	Image        string         `json:"image"`
+	Digest       string         `json:"digest,omitempty"`
+	Managed      bool           `json:"managed"`
+	Self         bool           `json:"self,omitempty"`
+	Reason       string         `json:"reason,omitempty"`
+	LatestDigest string         `json:"latestDigest,omitempty"`
+	LastCheck    *time.Time     `json:"lastCheck,omitempty"`
+	LastUpdate   *time.Time     `json:"lastUpdate,omitempty"`
+	Policy       *ServicePolicy `json:"policy,omitempty"`
+	PolicyError  string         `json:"policyError,omitempty"`
+}
+
+// serviceState is the last known update state of a service.
+type serviceState struct {
+	latestDigest string
+	lastCheck    time.Time
+	lastUpdate   time.Time
+}
+
+// stateStore keeps the update state of the services between runs.
+type stateStore struct {
+	mu       sync.Mutex
+	services map[string]serviceState
+}
+
+// recordCheck saves the digest resolved from the registry for the service.
+func (s *stateStore) recordCheck(serviceID, image string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.services == nil {
+		s.services = map[string]serviceState{}
+	}
+
+	state := s.services[serviceID]
+	state.latestDigest = imageDigest(image)
+	state.lastCheck = time.Now()
+	s.services[serviceID] = state
+}
+
+// recordUpdate saves the time of the last update triggered on the service.
+func (s *stateStore) recordUpdate(serviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.services == nil {
+		s.services = map[string]serviceState{}
+	}
+
+	state := s.services[serviceID]
+	state.lastUpdate = time.Now()
+	s.services[serviceID] = state
+}
+
+func (s *stateStore) get(serviceID string) (serviceState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.services[serviceID]
+
+	return state, ok
+}
+
+// imageDigest returns the digest of the image reference, if any.
+func imageDigest(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+
+	return ""
+}
+
+// serviceInfo describes the service and why it is managed or excluded by the updater.
+func (c *Swarm) serviceInfo(service swarm.Service) ServiceInfo {
+	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	managed, reason := c.serviceDecision(service)
+	_, self := service.Spec.Labels[serviceLabel]
+
+	info := ServiceInfo{
+		ID:      service.ID,
+		Name:    service.Spec.Name,
+		Stack:   service.Spec.Labels[stackNamespaceLabel],
+		Image:   image,
+		Digest:  imageDigest(image),
+		Managed: managed,
+		Self:    self,
+		Reason:  reason,
+	}
+
+	if state, ok := c.state.get(service.ID); ok {
+		info.LatestDigest = state.latestDigest
+		if !state.lastCheck.IsZero() {
+			info.LastCheck = &state.lastCheck
+		}
+		if !state.lastUpdate.IsZero() {
+			info.LastUpdate = &state.lastUpdate
+		}
+	}
+
+	policy, err := servicePolicy(service.Spec)
+	if err != nil {
+		info.PolicyError = err.Error()
+	} else {
+		info.Policy = &policy
+	}
+
+	return info
+}
+
+// Services lists every service of the swarm with its update state, whether it's managed by the updater or not.
+func (c *Swarm) Services(ctx context.Context) ([]ServiceInfo, error) {
+	services, err := c.serviceList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ServiceInfo, 0, len(services))
+	for _, service := range services {
+		result = append(result, c.serviceInfo(service))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestServices(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name string, labels map[string]string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.Labels = labels
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest@sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{
+			newService("web", map[string]string{canaryLabel: "1", canarySoakLabel: "1ms"}),
+			newService("db", nil),
+			newService("updater", map[string]string{serviceLabel: "true"}),
+			newService("broken", map[string]string{orderLabel: "random"}),
+		}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return newService(serviceID, nil), nil, nil
+	}
+	mock.TaskListFn = func(_ context.Context, _ types.TaskListOptions) ([]swarm.Task, error) {
+		task := swarm.Task{}
+		task.Spec.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest@" + newDigest}
+		task.Status.State = swarm.TaskStateRunning
+
+		return []swarm.Task{task}, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1, pollInterval: time.Millisecond, Blacklist: []*regexp.Regexp{regexp.MustCompile("^db$")}}
+	_, err := s.Update(context.TODO(), UpdateOptions{Services: []string{"web"}})
+	assert.NoError(err)
+
+	result, err := s.Services(context.TODO())
+	assert.NoError(err)
+	assert.Len(result, 4)
+
+	web := result[0]
+	assert.True(web.Managed)
+	assert.Equal("sha256:0000000000000000000000000000000000000000000000000000000000000000", web.Digest)
+	assert.Equal(newDigest, web.LatestDigest)
+	assert.NotNil(web.LastCheck)
+	assert.NotNil(web.LastUpdate)
+	assert.Equal(uint64(1), web.Policy.CanaryReplicas)
+	assert.Equal("1ms", web.Policy.CanarySoak)
+
+	db := result[1]
+	assert.False(db.Managed)
+	assert.Equal(`blacklist rule "^db$"`, db.Reason)
+	assert.Nil(db.LastCheck)
+
+	updater := result[2]
+	assert.True(updater.Managed)
+	assert.True(updater.Self)
+
+	broken := result[3]
+	assert.Nil(broken.Policy)
+	assert.NotEmpty(broken.PolicyError)
+
+	s.LabelEnable = true
+	result, err = s.Services(context.TODO())
+	assert.NoError(err)
+	assert.False(result[0].Managed)
+	assert.Contains(result[0].Reason, enabledServiceLabel)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// JobPending is a job waiting for more requests to merge before it starts
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	jobScheduled = "scheduled"
+	jobRequest   = "request"
+
+	// number of finished jobs kept in memory
+	maxJobs = 100
+)
+
+// Job is an update run started by the schedule or by a request.
+type Job struct {
+	ID       string `json:"id"`
+	Trigger  string `json:"trigger"`
+	Identity string `json:"identity,omitempty"`
+	// Callers are the other identities whose requests were merged on the job
+	Callers  []string       `json:"callers,omitempty"`
+	Status   string         `json:"status"`
+	Created  time.Time      `json:"created"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Request  *UpdateRequest `json:"request,omitempty"`
+	Result   *RunResult     `json:"result,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// jobStore keeps the running and the last finished jobs.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs []*Job
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func (s *jobStore) start(trigger, identity string, req *UpdateRequest) *Job {
+	return s.add(&Job{ID: newJobID(), Trigger: trigger, Identity: identity, Status: JobRunning, Created: time.Now(), Request: req})
+}
+
+// queue adds a pending job, its request is set when it starts.
+func (s *jobStore) queue(trigger, identity string) *Job {
+	return s.add(&Job{ID: newJobID(), Trigger: trigger, Identity: identity, Status: JobPending, Created: time.Now()})
+}
+
+// resume adds a pending job restored from the queue file, with its original id.
+func (s *jobStore) resume(id, trigger, identity string, created time.Time) *Job {
+	return s.add(&Job{ID: id, Trigger: trigger, Identity: identity, Status: JobPending, Created: created})
+}
+
+// join adds the identity of a merged request to the callers of the job.
+func (s *jobStore) join(job *Job, identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if identity != job.Identity && !slices.Contains(job.Callers, identity) {
+		job.Callers = append(job.Callers, identity)
+	}
+}
+
+// run marks the pending job as running with the request.
+func (s *jobStore) run(job *Job, req *UpdateRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.Request = req
+	job.Status = JobRunning
+}
+
+func (s *jobStore) add(job *Job) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs = append(s.jobs, job)
+
+	// forget the oldest finished jobs
+	for i := 0; len(s.jobs) > maxJobs && i < len(s.jobs); {
+		if s.jobs[i].Status == JobRunning || s.jobs[i].Status == JobPending {
+			i++
+			continue
+		}
+		s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+	}
+
+	return job
+}
+
+func (s *jobStore) finish(job *Job, result *RunResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.Finished = &now
+	job.Result = result
+	job.Status = JobDone
+
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+}
+
+// get returns a copy of the job, so it can be read while the job is running.
+func (s *jobStore) get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+
+	return Job{}, false
+}
+
+// list returns a copy of the jobs, the newest first.
+func (s *jobStore) list() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.jobs[i])
+	}
+
+	return jobs
+}
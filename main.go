@@ -31,8 +31,6 @@ import (
 
 	"github.com/docker/cli/cli/connhelper"
 	"github.com/docker/docker/client"
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 	"github.com/urfave/cli"
 )
 
@@ -43,18 +41,11 @@ const (
 
 var blacklist []*regexp.Regexp
 
-// UpdateRequest has a list of images that should be updated on the services that uses them
-type UpdateRequest struct {
-	Images []string `json:"images"`
-}
-
-func run(c *cli.Context) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
+// newSwarm creates the swarm client from the global flags, so it can be shared by every command.
+func newSwarm(c *cli.Context) (*Swarm, error) {
 	var opts []client.Opt
 
-	host := c.String("host")
+	host := c.GlobalString("host")
 	if host == "" {
 		host = os.Getenv("DOCKER_HOST")
 	}
@@ -63,7 +54,7 @@ func run(c *cli.Context) error {
 		if strings.HasPrefix(host, "ssh://") {
 			helper, err := connhelper.GetConnectionHelper(host)
 			if err != nil {
-				return fmt.Errorf("could not connect to SSH host %s: %w", host, err)
+				return nil, fmt.Errorf("could not connect to SSH host %s: %w", host, err)
 			}
 			opts = append(opts, client.WithHost(helper.Host))
 			opts = append(opts, client.WithDialContext(helper.Dialer))
@@ -80,67 +71,104 @@ func run(c *cli.Context) error {
 		opts = append(opts, client.WithAPIVersionNegotiation())
 	}
 
-	configDir := c.String("config")
+	mirrors, err := parseMirrorRules(c.GlobalStringSlice("registry-mirror"))
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorPolicy := c.GlobalString("registry-mirror-spec")
+	if mirrorPolicy != MirrorPolicyCanonical && mirrorPolicy != MirrorPolicyRewritten {
+		return nil, fmt.Errorf("invalid registry-mirror-spec %q, expected canonical or rewritten", mirrorPolicy)
+	}
+
+	credentials, err := newCredentialChain(CredentialOptions{
+		SecretsDir: c.GlobalString("credentials-dir"),
+		Helpers:    c.GlobalStringSlice("credential-helper"),
+		CacheTTL:   c.GlobalDuration("credential-cache-ttl"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	configDir := c.GlobalString("config")
 	if configDir == "" {
 		configDir = os.Getenv("DOCKER_CONFIG")
 	}
 
 	swarm, err := NewSwarm(configDir, opts...)
 	if err != nil {
-		return fmt.Errorf("cannot instantiate new Docker swarm client: %w", err)
+		return nil, fmt.Errorf("cannot instantiate new Docker swarm client: %w", err)
 	}
 
-	swarm.LabelEnable = c.Bool("label-enable")
+	swarm.LabelEnable = c.GlobalBool("label-enable")
 	swarm.Blacklist = blacklist
-	swarm.MaxThreads = c.Int("max-threads")
-	schedule := c.String("schedule")
+	swarm.MaxThreads = c.GlobalInt("max-threads")
+	swarm.Preflight = c.GlobalBool("preflight")
+	swarm.MinReadyWorkers = c.GlobalInt("min-ready-workers")
+	swarm.DataDir = c.GlobalString("data-dir")
+	swarm.DigestCacheTTL = c.GlobalDuration("digest-cache-ttl")
+	swarm.RegistryConcurrency = c.GlobalInt("registry-concurrency")
+	swarm.QuotaReserve = c.GlobalInt("registry-quota-reserve")
+	swarm.RegistryFailureThreshold = c.GlobalInt("registry-failure-threshold")
+	swarm.Mirrors = mirrors
+	swarm.registry = newRegistryClient(RegistryOptions{
+		Insecure: c.GlobalStringSlice("insecure-registry"),
+		CertsDir: c.GlobalString("registry-certs-dir"),
+	})
+	swarm.credentials = credentials
+	swarm.MirrorPolicy = mirrorPolicy
+	swarm.Retry = RetryPolicy{
+		Attempts: c.GlobalInt("retry-attempts"),
+		Delay:    c.GlobalDuration("retry-delay"),
+		MaxDelay: c.GlobalDuration("retry-max-delay"),
+	}
+
+	return swarm, nil
+}
+
+// serve runs the updater on the configured schedule and serves the http endpoint.
+func serve(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slog.Info("Starting Swarm Updater",
+		"version", Tag,
+		"commit", Revision,
+		"date", LastCommit,
+		"clean_build", !Modified)
+
+	swarm, err := newSwarm(c)
+	if err != nil {
+		return err
+	}
+
+	schedule := c.GlobalString("schedule")
 
 	// update the services and exit, if requested
 	if schedule == "none" {
-		return swarm.UpdateServices(ctx)
+		_, err := swarm.UpdateServices(ctx)
+		return err
 	}
 
-	cron, err := NewCronService(schedule, func() {
-		if updateErr := swarm.UpdateServices(ctx); updateErr != nil {
-			slog.Error("Failed to update services", "error", updateErr.Error())
-		}
-	})
+	auth, err := newAuthentication(ctx, c)
 	if err != nil {
-		return fmt.Errorf("failed to setup cron, %w", err)
+		return err
 	}
 
-	e := echo.New()
-	e.HideBanner = true
-	e.Debug = c.Bool("debug")
-	e.Use(middleware.Recover())
-	apiKey := c.String("apikey")
-	e.Use(middleware.KeyAuth(func(key string, _ echo.Context) (bool, error) {
-		return key == apiKey, nil
-	}))
-
-	e.POST("/apis/swarm/v1/update", func(c echo.Context) error {
-		req := &UpdateRequest{}
-		if err := c.Bind(req); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "Bind:"+err.Error())
-		}
-
-		if len(req.Images) == 0 {
-			return echo.NewHTTPError(http.StatusBadRequest, "No images to update")
-		}
-
-		slog.Info("Received update request", "images", strings.Join(req.Images, ","))
+	srv := newServer(ctx, swarm, auth)
+	srv.updatesPerMinute = c.GlobalInt("rate-limit")
+	srv.queue.debounce = c.GlobalDuration("debounce")
 
-		if err := swarm.UpdateServices(c.Request().Context(), req.Images...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Swarm update:"+err.Error())
-		}
+	cron, err := NewCronService(schedule, srv.scheduled)
+	if err != nil {
+		return fmt.Errorf("failed to setup cron, %w", err)
+	}
 
-		return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
-	})
+	e := srv.echo(c.GlobalBool("debug"))
 
-	svr := &http.Server{
-		Addr:         c.String("listen"),
-		ReadTimeout:  DefaultTimeout,
-		WriteTimeout: DefaultTimeout,
+	svr, err := newHTTPServer(c, c.GlobalString("listen"))
+	if err != nil {
+		return err
 	}
 
 	go func() {
@@ -161,20 +189,77 @@ func run(c *cli.Context) error {
 
 	cron.Stop()
 
+	slog.Info("Waiting for running updates to be finished...")
+	srv.queue.close()
+
 	return nil
 }
 
+// tlsOptions returns the tls settings shared by the http endpoints.
+func tlsOptions(c *cli.Context) TLSOptions {
+	return TLSOptions{
+		CertFile:       c.GlobalString("tls-cert"),
+		KeyFile:        c.GlobalString("tls-key"),
+		ClientCAFile:   c.GlobalString("tls-client-ca"),
+		ClientSubjects: c.GlobalStringSlice("tls-client-subjects"),
+	}
+}
+
+// newHTTPServer returns a server on the address with the tls settings, every endpoint should be served with it.
+func newHTTPServer(c *cli.Context, addr string) (*http.Server, error) {
+	config, err := newTLSConfig(tlsOptions(c))
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Addr:         addr,
+		ReadTimeout:  DefaultTimeout,
+		WriteTimeout: DefaultTimeout,
+		TLSConfig:    config,
+	}, nil
+}
+
+// newAuthentication loads the api keys and the OIDC settings of the http endpoint.
+func newAuthentication(ctx context.Context, c *cli.Context) (*authenticator, error) {
+	keys, err := newKeyStore(c.GlobalString("apikey"), c.GlobalString("apikey-file"))
+	if err != nil {
+		return nil, err
+	}
+
+	var oidc *oidcVerifier
+	if jwksSource := c.GlobalString("oidc-jwks"); jwksSource != "" {
+		oidc, err = newOIDCVerifier(ctx, jwksSource, c.GlobalString("oidc-issuer"),
+			c.GlobalString("oidc-audience"), c.GlobalString("oidc-rules"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth, err := newAuthenticator(keys, oidc, c.GlobalBool("allow-no-auth"))
+	if err != nil {
+		return nil, err
+	}
+
+	signedRoutes := c.GlobalStringSlice("signed-routes")
+	if err := validateRoutes(signedRoutes); err != nil {
+		return nil, err
+	}
+
+	if len(signedRoutes) > 0 && len(keys.keys) == 0 {
+		return nil, fmt.Errorf("%w, the signed routes need an api key to verify the signatures", ErrNoAPIKey)
+	}
+
+	auth.signedRoutes = signedRoutes
+
+	return auth, nil
+}
+
 func initialize(c *cli.Context) error {
 	if c.Bool("label-enable") && (c.IsSet("blacklist") || c.IsSet("blacklist-regex")) {
 		slog.Error("Do not define a blacklist if label-enable is enabled")
 	}
 
-	slog.Info("Starting Swarm Updater",
-		"version", Tag,
-		"commit", Revision,
-		"date", LastCommit,
-		"clean_build", !Modified)
-
 	if c.Bool("debug") {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
@@ -210,7 +295,8 @@ func printVersion(_ *cli.Context) {
 		"clean_build", !Modified)
 }
 
-func main() {
+// newApp returns the command line application with its flags and commands.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Usage = "automatically update Docker services"
 	app.Version = Tag
@@ -258,18 +344,364 @@ func main() {
 			Usage:  "api key to protect endpoint",
 			EnvVar: "APIKEY",
 		},
+		cli.StringFlag{
+			Name:   "apikey-file",
+			Usage:  "json file with the named api keys, their scopes and allowed services",
+			EnvVar: "APIKEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "oidc-jwks",
+			Usage:  "file or url of the jwks used to verify the oidc tokens of the callers",
+			EnvVar: "OIDC_JWKS",
+		},
+		cli.StringFlag{
+			Name:   "oidc-issuer",
+			Usage:  "expected issuer of the oidc tokens",
+			EnvVar: "OIDC_ISSUER",
+		},
+		cli.StringFlag{
+			Name:   "oidc-audience",
+			Usage:  "expected audience of the oidc tokens",
+			EnvVar: "OIDC_AUDIENCE",
+		},
+		cli.StringFlag{
+			Name:   "oidc-rules",
+			Usage:  "json file with the rules that map the token claims to the allowed services",
+			EnvVar: "OIDC_RULES",
+		},
+		cli.StringSliceFlag{
+			Name:   "signed-routes",
+			Usage:  "routes that only accept requests signed with an api key (update, services, explain, rollback, history, jobs, queue, cache, errors)",
+			EnvVar: "SIGNED_ROUTES",
+		},
+		cli.BoolFlag{
+			Name:   "allow-no-auth",
+			Usage:  "serve the http endpoint without authentication if no api key is configured",
+			EnvVar: "ALLOW_NO_AUTH",
+		},
 		cli.IntFlag{
 			Name:   "max-threads, m",
 			Usage:  "max threads",
 			EnvVar: "MAX_THREADS",
 			Value:  1,
 		},
+		cli.BoolFlag{
+			Name:   "preflight",
+			Usage:  "check the swarm health before updating the services",
+			EnvVar: "PREFLIGHT",
+		},
+		cli.IntFlag{
+			Name:   "min-ready-workers",
+			Usage:  "minimum number of ready workers required to start an update",
+			EnvVar: "MIN_READY_WORKERS",
+		},
+		cli.IntFlag{
+			Name:   "rate-limit",
+			Usage:  "max update requests per minute of each api key or token, 0 disables the limit",
+			EnvVar: "RATE_LIMIT",
+		},
+		cli.DurationFlag{
+			Name:   "debounce",
+			Usage:  "merge the image update requests received during this window into a single run, the callers must have the same access rule",
+			EnvVar: "DEBOUNCE",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "certificate file of the http endpoint, it's reloaded when the file changes",
+			EnvVar: "TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "private key file of the http endpoint",
+			EnvVar: "TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-client-ca",
+			Usage:  "CA bundle used to verify the client certificates, they are required if set",
+			EnvVar: "TLS_CLIENT_CA",
+		},
+		cli.StringSliceFlag{
+			Name:   "tls-client-subjects",
+			Usage:  "glob patterns of the client certificate common names allowed to connect",
+			EnvVar: "TLS_CLIENT_SUBJECTS",
+		},
+		cli.DurationFlag{
+			Name:   "digest-cache-ttl",
+			Usage:  "reuse the resolved image digests on the next runs during this time, 0 only reuses them during a run",
+			EnvVar: "DIGEST_CACHE_TTL",
+		},
+		cli.IntFlag{
+			Name:   "registry-concurrency",
+			Usage:  "max concurrent image lookups on each registry, 0 disables the limit",
+			EnvVar: "REGISTRY_CONCURRENCY",
+		},
+		cli.IntFlag{
+			Name:   "registry-quota-reserve",
+			Usage:  "defer the services of a registry when its remaining pull quota is at or below this value, 0 disables the check",
+			EnvVar: "REGISTRY_QUOTA_RESERVE",
+		},
+		cli.StringFlag{
+			Name:   "credentials-dir",
+			Usage:  "directory with the <registry>.json and <name>@<registry>.json credential files, like /run/secrets",
+			EnvVar: "CREDENTIALS_DIR",
+		},
+		cli.StringSliceFlag{
+			Name:   "credential-helper",
+			Usage:  "docker credential helper of the registries that match a pattern, like '*.dkr.ecr.*.amazonaws.com=ecr-login'",
+			EnvVar: "CREDENTIAL_HELPERS",
+		},
+		cli.DurationFlag{
+			Name:   "credential-cache-ttl",
+			Usage:  "reuse the credentials returned by the credential helpers during this time",
+			EnvVar: "CREDENTIAL_CACHE_TTL",
+			Value:  10 * time.Minute,
+		},
+		cli.StringSliceFlag{
+			Name:   "registry-mirror",
+			Usage:  "rewrite rules like 'docker.io/* -> mirror.local/dockerhub/*', the mirrors are tried in order before the registry",
+			EnvVar: "REGISTRY_MIRRORS",
+		},
+		cli.StringFlag{
+			Name:   "registry-mirror-spec",
+			Usage:  "image name saved on the services resolved from a mirror (canonical, rewritten)",
+			EnvVar: "REGISTRY_MIRROR_SPEC",
+			Value:  MirrorPolicyCanonical,
+		},
+		cli.StringSliceFlag{
+			Name:   "insecure-registry",
+			Usage:  "registry hosts, like mirror.local:5000, that are reached over plain http to read the digests",
+			EnvVar: "INSECURE_REGISTRIES",
+		},
+		cli.StringFlag{
+			Name:   "registry-certs-dir",
+			Usage:  "directory with the <host>/ca.crt CA bundles and client certificates of the registries",
+			EnvVar: "REGISTRY_CERTS_DIR",
+			Value:  "/etc/docker/certs.d",
+		},
+		cli.IntFlag{
+			Name:   "registry-failure-threshold",
+			Usage:  "consecutive failed lookups that stop using a registry until the next run, 0 disables it",
+			EnvVar: "REGISTRY_FAILURE_THRESHOLD",
+			Value:  5,
+		},
+		cli.IntFlag{
+			Name:   "retry-attempts",
+			Usage:  "max attempts of a service update that fails with a conflict, network or server error",
+			EnvVar: "RETRY_ATTEMPTS",
+			Value:  defaultRetryAttempts,
+		},
+		cli.DurationFlag{
+			Name:   "retry-delay",
+			Usage:  "wait before the first retry of a service update, doubled on every retry",
+			EnvVar: "RETRY_DELAY",
+			Value:  time.Second,
+		},
+		cli.DurationFlag{
+			Name:   "retry-max-delay",
+			Usage:  "max wait between the retries of a service update",
+			EnvVar: "RETRY_MAX_DELAY",
+			Value:  30 * time.Second,
+		},
+		cli.StringFlag{
+			Name:   "data-dir",
+			Usage:  "directory where the update history and queue are saved, they are kept in memory if empty",
+			EnvVar: "DATA_DIR",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "serve",
+			Usage:  "update the services on schedule and serve the http endpoint (default)",
+			Action: serve,
+		},
+		{
+			Name:   "check",
+			Usage:  "show the services that would be updated, exits with 3 if any",
+			Flags:  append([]cli.Flag{outputFlag}, selectionFlags...),
+			Action: check,
+		},
+		{
+			Name:  "update",
+			Usage: "update the selected services once, or every service if none is selected",
+			Flags: append([]cli.Flag{
+				outputFlag,
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "redeploy the selected services even if their image didn't change",
+				},
+			}, selectionFlags...),
+			Action: update,
+		},
+		{
+			Name:   "list",
+			Usage:  "list the services and if they are managed by the updater",
+			Flags:  []cli.Flag{outputFlag},
+			Action: list,
+		},
+		{
+			Name:      "rollback",
+			Usage:     "rollback a service to its previous spec",
+			ArgsUsage: "<service>",
+			Action:    rollback,
+		},
+		{
+			Name:  "history",
+			Usage: "show the updates and rollbacks done by the updater",
+			Flags: []cli.Flag{
+				outputFlag,
+				cli.StringFlag{
+					Name:  "service",
+					Usage: "show only the history of this service",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Usage: "max number of entries, zero shows every entry",
+					Value: 20,
+				},
+			},
+			Action: history,
+		},
+		{
+			Name:      "explain",
+			Usage:     "show why a service is or isn't updated",
+			ArgsUsage: "<service>",
+			Flags:     []cli.Flag{outputFlag},
+			Action:    explain,
+		},
+		{
+			Name:  "validate-config",
+			Usage: "validate the updater options, exits with 1 if invalid",
+			Flags: []cli.Flag{
+				outputFlag,
+				cli.BoolFlag{
+					Name:  "services",
+					Usage: "also validate the update policy labels of the managed services",
+				},
+			},
+			Action: validateConfig,
+		},
+		{
+			Name:  "remote",
+			Usage: "run the commands on a running updater through its http endpoint",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "url",
+					Usage:  "url of the updater, for example https://updater.example.com",
+					EnvVar: "SWARM_UPDATER_URL",
+				},
+				cli.StringFlag{
+					Name:   "apikey",
+					Usage:  "api key of the updater endpoint",
+					EnvVar: "SWARM_UPDATER_APIKEY",
+				},
+				cli.BoolFlag{
+					Name:   "sign",
+					Usage:  "sign the requests with the api key instead of sending it",
+					EnvVar: "SWARM_UPDATER_SIGN",
+				},
+				cli.StringFlag{
+					Name:   "ca-cert",
+					Usage:  "CA bundle used to verify the updater certificate",
+					EnvVar: "SWARM_UPDATER_CA_CERT",
+				},
+				cli.StringFlag{
+					Name:   "client-cert",
+					Usage:  "client certificate file, for updaters that verify the client certificates",
+					EnvVar: "SWARM_UPDATER_CLIENT_CERT",
+				},
+				cli.StringFlag{
+					Name:   "client-key",
+					Usage:  "client certificate private key file",
+					EnvVar: "SWARM_UPDATER_CLIENT_KEY",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "update",
+					Usage:     "update the selected services, the arguments are service names",
+					ArgsUsage: "[service...]",
+					Flags: append([]cli.Flag{
+						outputFlag,
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "redeploy the selected services even if their image didn't change",
+						},
+						cli.BoolFlag{
+							Name:  "async",
+							Usage: "return the job id without waiting for the update",
+						},
+					}, selectionFlags...),
+					Action: remoteUpdate,
+				},
+				{
+					Name:   "list",
+					Usage:  "list the services and if they are managed by the updater",
+					Flags:  []cli.Flag{outputFlag},
+					Action: remoteList,
+				},
+				{
+					Name:      "explain",
+					Usage:     "show why a service is or isn't updated",
+					ArgsUsage: "<service>",
+					Flags:     []cli.Flag{outputFlag},
+					Action:    remoteExplain,
+				},
+				{
+					Name:      "rollback",
+					Usage:     "rollback a service to its previous spec",
+					ArgsUsage: "<service>",
+					Action:    remoteRollback,
+				},
+				{
+					Name:  "history",
+					Usage: "show the updates and rollbacks done by the updater",
+					Flags: []cli.Flag{
+						outputFlag,
+						cli.StringFlag{
+							Name:  "service",
+							Usage: "show only the history of this service",
+						},
+						cli.IntFlag{
+							Name:  "limit",
+							Usage: "max number of entries, zero shows every entry",
+							Value: 20,
+						},
+					},
+					Action: remoteHistory,
+				},
+				{
+					Name:      "jobs",
+					Usage:     "list the update jobs, or show a single job",
+					ArgsUsage: "[job]",
+					Flags: []cli.Flag{
+						outputFlag,
+						cli.BoolFlag{
+							Name:  "wait",
+							Usage: "wait until the job is finished",
+						},
+					},
+					Action: remoteJobs,
+				},
+				{
+					Name:   "queue",
+					Usage:  "show the number of pending and running updates",
+					Flags:  []cli.Flag{outputFlag},
+					Action: remoteQueue,
+				},
+			},
+		},
 	}
 
 	app.Before = initialize
-	app.Action = run
+	app.Action = serve
+
+	return app
+}
 
-	if err := app.Run(os.Args); err != nil {
+func main() {
+	if err := newApp().Run(os.Args); err != nil {
 		slog.Error("Cannot start program", "error", err.Error())
+		os.Exit(exitError)
 	}
 }
@@ -0,0 +1,226 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrInvalidImagePattern is returned when a requested image can't be parsed.
+var ErrInvalidImagePattern = errors.New("invalid image pattern")
+
+// UpdateTarget selects the services running an image and optionally deploys a different tag or an exact digest.
+type UpdateTarget struct {
+	Image  string `json:"image"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// imagePattern matches service images by their normalized reference. The name can contain glob wildcards.
+type imagePattern struct {
+	raw  string
+	name string
+	tag  string
+	// target is the tag and digest to deploy on the matched services, if any
+	target imageTarget
+}
+
+// imageTarget is the tag and digest that should be deployed instead of the latest digest of the current tag.
+type imageTarget struct {
+	tag    string
+	digest digest.Digest
+	// force redeploys the service even if the digest didn't change
+	force bool
+	// dryRun only reports if the service would be updated
+	dryRun bool
+	// run identifies the update run, the digests resolved by it are reused for its other services
+	run uint64
+	// credential is the named registry credential selected by the service label, empty for the default one
+	credential string
+}
+
+// normalizeName adds the default domain and repository prefix to a name, like reference.ParseNormalizedNamed
+// does but without validating it, so it can be used with glob patterns.
+func normalizeName(name string) string {
+	domain, remainder := "docker.io", name
+
+	i := strings.IndexRune(name, '/')
+	if i != -1 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		domain, remainder = name[:i], name[i+1:]
+	}
+
+	if domain == "index.docker.io" {
+		domain = "docker.io"
+	}
+
+	if domain == "docker.io" && !strings.ContainsRune(remainder, '/') {
+		remainder = "library/" + remainder
+	}
+
+	return domain + "/" + remainder
+}
+
+// parseImagePattern parses an image reference with an optional tag and digest. When no tag is given the pattern
+// matches every tag of the image. The digest isn't used for matching but as the exact image to be deployed.
+func parseImagePattern(pattern string) (imagePattern, error) {
+	result := imagePattern{raw: pattern}
+	name := strings.TrimSpace(pattern)
+
+	if i := strings.IndexRune(name, '@'); i != -1 {
+		dgst, err := digest.Parse(name[i+1:])
+		if err != nil {
+			return result, fmt.Errorf("%w: %q: %w", ErrInvalidImagePattern, pattern, err)
+		}
+		name, result.target.digest = name[:i], dgst
+	}
+
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name, result.tag = name[:i], name[i+1:]
+	}
+
+	if name == "" {
+		return result, fmt.Errorf("%w: %q", ErrInvalidImagePattern, pattern)
+	}
+
+	if strings.ContainsAny(name, "*?[") {
+		result.name = normalizeName(name)
+		if _, err := path.Match(result.name, ""); err != nil {
+			return result, fmt.Errorf("%w: %q: %w", ErrInvalidImagePattern, pattern, err)
+		}
+	} else {
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return result, fmt.Errorf("%w: %q: %w", ErrInvalidImagePattern, pattern, err)
+		}
+		result.name = named.Name()
+	}
+
+	if result.tag != "" {
+		if err := validateTag(result.tag); err != nil {
+			return result, fmt.Errorf("%w: %q: %w", ErrInvalidImagePattern, pattern, err)
+		}
+	}
+
+	return result, nil
+}
+
+// parseUpdateTarget parses the image pattern of the target and sets the tag and digest that should be deployed.
+func parseUpdateTarget(target UpdateTarget) (imagePattern, error) {
+	result, err := parseImagePattern(target.Image)
+	if err != nil {
+		return result, err
+	}
+
+	if target.Tag != "" {
+		if err := validateTag(target.Tag); err != nil {
+			return result, fmt.Errorf("%w: %q: %w", ErrInvalidImagePattern, target.Tag, err)
+		}
+		result.target.tag = target.Tag
+	}
+
+	if target.Digest != "" {
+		if result.target.digest != "" {
+			return result, fmt.Errorf("%w: %q: digest defined twice", ErrInvalidImagePattern, target.Image)
+		}
+
+		dgst, err := digest.Parse(target.Digest)
+		if err != nil {
+			return result, fmt.Errorf("%w: %q: %w", ErrInvalidImagePattern, target.Digest, err)
+		}
+		result.target.digest = dgst
+	}
+
+	return result, nil
+}
+
+func parseImagePatterns(images []string, targets []UpdateTarget) ([]imagePattern, error) {
+	var result []imagePattern
+
+	for _, image := range images {
+		parsed, err := parseImagePattern(image)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, parsed)
+	}
+
+	for _, target := range targets {
+		parsed, err := parseUpdateTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, parsed)
+	}
+
+	return result, nil
+}
+
+// validateTag checks that the tag has a valid format.
+func validateTag(tag string) error {
+	if loc := reference.TagRegexp.FindStringIndex(tag); loc == nil || loc[0] != 0 || loc[1] != len(tag) {
+		return reference.ErrTagInvalidFormat
+	}
+
+	return nil
+}
+
+// match reports if the image of a service matches the pattern.
+func (p imagePattern) match(image string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+
+	if matched, _ := path.Match(p.name, named.Name()); !matched {
+		return false
+	}
+
+	if p.tag != "" {
+		tagged, ok := named.(reference.Tagged)
+		if !ok || tagged.Tag() != p.tag {
+			return false
+		}
+	}
+
+	return true
+}
+
+// targetImage returns the image name that should be resolved for the service, replacing its tag if the target
+// requests it.
+func (t imageTarget) targetImage(image string) (string, error) {
+	if t.tag == "" {
+		return image, nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	tagged, err := reference.WithTag(reference.TrimNamed(named), t.tag)
+	if err != nil {
+		return "", fmt.Errorf("failed to set tag %s: %w", t.tag, err)
+	}
+
+	return reference.FamiliarString(tagged), nil
+}
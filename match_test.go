@@ -0,0 +1,163 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestImagePatternMatch(t *testing.T) {
+	assert := test.New(t)
+
+	tests := []struct {
+		pattern string
+		image   string
+		match   bool
+	}{
+		{"myapp", "myapp:latest", true},
+		{"myapp", "myapp-worker:latest", false},
+		{"nginx", "docker.io/library/nginx:1.27", true},
+		{"docker.io/library/nginx", "nginx:1.27@" + newDigest, true},
+		{"nginx:1.27", "nginx:1.27@" + newDigest, true},
+		{"nginx:1.27", "nginx:1.26", false},
+		{"nginx@" + newDigest, "nginx:1.27@" + newDigest, true},
+		{"ghcr.io/acme/*", "ghcr.io/acme/app:v1", true},
+		{"ghcr.io/acme/*", "ghcr.io/other/app:v1", false},
+		{"ghcr.io/acme/*:v1", "ghcr.io/acme/app:v2", false},
+		{"localhost:5000/app", "localhost:5000/app:latest", true},
+		{"mycompany/*", "mycompany/myapp", true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := parseImagePattern(tt.pattern)
+		assert.NoError(err)
+		assert.Equal(tt.match, pattern.match(tt.image), "%s should match %s: %v", tt.pattern, tt.image, tt.match)
+	}
+
+	_, err := parseImagePattern("Invalid Image")
+	assert.ErrorIs(err, ErrInvalidImagePattern)
+
+	_, err = parseImagePattern("ghcr.io/acme/[")
+	assert.ErrorIs(err, ErrInvalidImagePattern)
+}
+
+func TestUpdateServicesMatches(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		var services []swarm.Service
+		for _, name := range []string{"myapp", "myapp-worker"} {
+			services = append(services, swarm.Service{
+				ID: name,
+				Spec: swarm.ServiceSpec{
+					Annotations:  swarm.Annotations{Name: name},
+					TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: name + ":latest"}},
+				},
+			})
+		}
+
+		return services, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1}
+	result, err := s.UpdateServices(context.TODO(), "myapp", "other")
+	assert.NoError(err)
+	assert.Equal(map[string][]string{"myapp": {"myapp"}, "other": {}}, result.Matches)
+}
+
+func TestParseUpdateTarget(t *testing.T) {
+	assert := test.New(t)
+
+	pattern, err := parseImagePattern("myapp:v1@" + newDigest)
+	assert.NoError(err)
+	assert.Equal("v1", pattern.tag)
+	assert.Equal(digest.Digest(newDigest), pattern.target.digest)
+
+	pattern, err = parseUpdateTarget(UpdateTarget{Image: "myapp:staging", Tag: "v2"})
+	assert.NoError(err)
+	assert.Equal("staging", pattern.tag)
+	assert.Equal("v2", pattern.target.tag)
+
+	image, err := pattern.target.targetImage("myapp:staging")
+	assert.NoError(err)
+	assert.Equal("myapp:v2", image)
+
+	_, err = parseUpdateTarget(UpdateTarget{Image: "myapp", Tag: "bad tag"})
+	assert.ErrorIs(err, ErrInvalidImagePattern)
+
+	_, err = parseUpdateTarget(UpdateTarget{Image: "myapp@" + newDigest, Digest: newDigest})
+	assert.ErrorIs(err, ErrInvalidImagePattern)
+
+	_, err = parseImagePattern("myapp@sha256:1234")
+	assert.ErrorIs(err, ErrInvalidImagePattern)
+}
+
+func TestUpdateTargets(t *testing.T) {
+	assert := test.New(t)
+
+	services := map[string]*swarm.Service{}
+	for _, name := range []string{"web", "worker"} {
+		services[name] = &swarm.Service{
+			ID: name,
+			Spec: swarm.ServiceSpec{
+				Annotations:  swarm.Annotations{Name: name},
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "myapp/" + name + ":staging"}},
+			},
+			PreviousSpec: &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}},
+		}
+	}
+
+	var inspected []string
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{*services["web"], *services["worker"]}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, image, _ string) (registry.DistributionInspect, error) {
+		inspected = append(inspected, image)
+
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return *services[serviceID], nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, spec swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		services[serviceID].Spec = spec
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1}
+	result, err := s.Update(context.TODO(), UpdateOptions{
+		Images:  []string{"myapp/web:staging@" + newDigest},
+		Targets: []UpdateTarget{{Image: "myapp/worker:staging", Tag: "v2"}},
+	})
+	assert.NoError(err)
+	assert.Len(result.Services, 2)
+	assert.ElementsMatch([]string{"myapp/web@" + newDigest, "myapp/worker:v2"}, inspected)
+	assert.Equal("myapp/web:staging@"+newDigest, services["web"].Spec.TaskTemplate.ContainerSpec.Image)
+	assert.Equal("myapp/worker:v2@"+newDigest, services["worker"].Spec.TaskTemplate.ContainerSpec.Image)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const (
+	// MirrorPolicyCanonical keeps the original image name on the service spec
+	MirrorPolicyCanonical = "canonical"
+	// MirrorPolicyRewritten changes the image name on the service spec to the mirror that resolved it
+	MirrorPolicyRewritten = "rewritten"
+)
+
+var ErrInvalidMirrorRule = errors.New("invalid registry mirror rule")
+
+// mirrorRule rewrites the image names that start with the source prefix to the target prefix, like
+// docker.io/* -> mirror.local/dockerhub/*.
+type mirrorRule struct {
+	raw    string
+	source string
+	target string
+}
+
+// parseMirrorRules parses rules like docker.io/* -> mirror.local/dockerhub/*. The rules of the same registry are
+// tried in order.
+func parseMirrorRules(rules []string) ([]mirrorRule, error) {
+	parsed := make([]mirrorRule, 0, len(rules))
+
+	for _, raw := range rules {
+		source, target, found := strings.Cut(raw, "->")
+		source = strings.TrimSpace(source)
+		target = strings.TrimSpace(target)
+
+		if !found || !strings.HasSuffix(source, "/*") || !strings.HasSuffix(target, "/*") {
+			return nil, fmt.Errorf("%w: %q, expected a rule like docker.io/* -> mirror.local/dockerhub/*",
+				ErrInvalidMirrorRule, raw)
+		}
+
+		rule := mirrorRule{raw: raw, source: strings.TrimSuffix(source, "*"), target: strings.TrimSuffix(target, "*")}
+
+		// the target must be a valid repository prefix
+		if _, err := reference.ParseNormalizedNamed(rule.target + "image"); err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrInvalidMirrorRule, raw, err)
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+// rewrite returns the name of the image on the mirror, if the rule matches it.
+func (r mirrorRule) rewrite(named reference.Named) (reference.Named, bool) {
+	name := named.String()
+	if !strings.HasPrefix(name, r.source) {
+		return nil, false
+	}
+
+	rewritten, err := reference.ParseNormalizedNamed(r.target + strings.TrimPrefix(name, r.source))
+	if err != nil {
+		return nil, false
+	}
+
+	return rewritten, true
+}
+
+// mirrorCandidate is the name of an image on one of its mirrors.
+type mirrorCandidate struct {
+	rule  *mirrorRule
+	image string
+}
+
+// mirrorsOf returns the names of the image on its mirrors, in the order of the rules.
+func (c *Swarm) mirrorsOf(image string) []mirrorCandidate {
+	if len(c.Mirrors) == 0 {
+		return nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []mirrorCandidate
+	for i := range c.Mirrors {
+		if rewritten, ok := c.Mirrors[i].rewrite(named); ok {
+			candidates = append(candidates, mirrorCandidate{rule: &c.Mirrors[i], image: rewritten.String()})
+		}
+	}
+
+	return candidates
+}
+
+// specName returns the name that is saved on the service spec for an image resolved from the mirror, which is the
+// original one unless the policy keeps the rewritten one.
+func (c *Swarm) specName(named reference.Named, mirror *mirrorRule) reference.Named {
+	if mirror == nil || c.MirrorPolicy != MirrorPolicyRewritten {
+		return named
+	}
+
+	if rewritten, ok := mirror.rewrite(named); ok {
+		return rewritten
+	}
+
+	return named
+}
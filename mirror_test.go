@@ -0,0 +1,133 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestParseMirrorRules(t *testing.T) {
+	assert := test.New(t)
+
+	rules, err := parseMirrorRules([]string{"docker.io/* -> mirror.local/dockerhub/*", "ghcr.io/mycompany/*->mirror.local/ghcr/*"})
+	assert.NoError(err)
+	assert.Len(rules, 2)
+
+	named, err := reference.ParseNormalizedNamed("nginx:1.27")
+	assert.NoError(err)
+
+	rewritten, ok := rules[0].rewrite(named)
+	assert.True(ok)
+	assert.Equal("mirror.local/dockerhub/library/nginx:1.27", rewritten.String())
+
+	_, ok = rules[1].rewrite(named)
+	assert.False(ok)
+
+	for _, rule := range []string{"docker.io/*", "docker.io -> mirror.local", "docker.io/* -> Mirror.local/UPPER/*"} {
+		_, err := parseMirrorRules([]string{rule})
+		assert.ErrorIs(err, ErrInvalidMirrorRule, rule)
+	}
+}
+
+func TestMirrorResolution(t *testing.T) {
+	assert := test.New(t)
+
+	const mirrorDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+
+	var down atomic.Bool
+	broken := newTestRegistry(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mirror := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.URL.Path != "/v2/dockerhub/mycompany/web/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", mirrorDigest)
+	})
+
+	brokenHost := strings.TrimPrefix(broken.URL, "https://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "https://")
+
+	rules, err := parseMirrorRules([]string{
+		"docker.io/* -> " + brokenHost + "/dockerhub/*",
+		"docker.io/* -> " + mirrorHost + "/dockerhub/*",
+	})
+	assert.NoError(err)
+
+	var inspects atomic.Int32
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return newImageServices("mycompany/web:1.0", "ghcr.io/mycompany/api:1.0"), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		inspects.Add(1)
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+
+	// both test registries use the same certificate
+	s := &Swarm{client: &mock, MaxThreads: 1, Mirrors: rules, MirrorPolicy: MirrorPolicyCanonical,
+		registry: &registryClient{client: mirror.Client()}}
+
+	images := func(run *RunResult) map[string]string {
+		images := map[string]string{}
+		for _, service := range run.Services {
+			images[service.Service] = service.Image
+		}
+
+		return images
+	}
+
+	// the second mirror resolves the image, the images of other registries don't use them
+	run, err := s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"service0": "mycompany/web:1.0@" + mirrorDigest,
+		"service1": "ghcr.io/mycompany/api:1.0@" + newDigest,
+	}, images(run))
+	assert.Equal(int32(1), inspects.Load())
+
+	s.MirrorPolicy = MirrorPolicyRewritten
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(mirrorHost+"/dockerhub/mycompany/web:1.0@"+mirrorDigest, images(run)["service0"])
+
+	// the registry of the image is the last fallback
+	down.Store(true)
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal("mycompany/web:1.0@"+newDigest, images(run)["service0"])
+	assert.Equal(int32(4), inspects.Load())
+}
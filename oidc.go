@@ -0,0 +1,366 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// the keys are fetched again after this interval, or when a token is signed by an unknown key
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+	// allowed clock skew between the updater and the token issuer
+	tokenLeeway = 30 * time.Second
+)
+
+var (
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrInvalidJWKS      = errors.New("invalid jwks")
+	ErrInvalidOIDCRules = errors.New("invalid oidc rules")
+)
+
+// OIDCRule maps the claims of a token, like repository, ref or environment, to the actions and services that its
+// caller can use.
+type OIDCRule struct {
+	Name string `json:"name"`
+	// Claims has the glob patterns that the claims of the token must match
+	Claims map[string]string `json:"claims"`
+	Scopes []string          `json:"scopes"`
+	AccessRule
+}
+
+// match reports if every claim of the rule matches the claims of the token.
+func (r *OIDCRule) match(claims jwt.MapClaims) bool {
+	for name, pattern := range r.Claims {
+		value, ok := claims[name].(string)
+		if !ok {
+			return false
+		}
+
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
+
+// publicKey returns the RSA or EC public key of the JWK.
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var point ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, point = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, point = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, point = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		// check that the point is on the curve
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x.Bytes()) > size || len(y.Bytes()) > size {
+			return nil, errors.New("invalid ec point")
+		}
+		uncompressed := append([]byte{4}, append(x.FillBytes(make([]byte, size)), y.FillBytes(make([]byte, size))...)...)
+		if _, err := point.NewPublicKey(uncompressed); err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// jwks has the keys used to verify the tokens, loaded from a file or an url.
+type jwks struct {
+	source  string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+}
+
+func (j *jwks) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(j.source, "https://") && !strings.HasPrefix(j.source, "http://") {
+		return os.ReadFile(j.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// load replaces the keys with the ones from the source. The keys that aren't used for signatures are ignored.
+func (j *jwks) load(ctx context.Context) error {
+	j.fetched = time.Now()
+
+	data, err := j.read(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: cannot read %s: %w", ErrInvalidJWKS, j.source, err)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJWKS, err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		publicKey, err := key.publicKey()
+		if err != nil {
+			slog.Warn("Ignoring invalid key in jwks", "kid", key.Kid, "error", err.Error())
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: no signature keys found in %s", ErrInvalidJWKS, j.source)
+	}
+
+	j.keys = keys
+
+	return nil
+}
+
+// key returns the key with the id, the keys are loaded again if they are old or if the id is unknown.
+func (j *jwks) key(ctx context.Context, kid string) (any, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	lookup := func() (any, bool) {
+		if key, ok := j.keys[kid]; ok {
+			return key, true
+		}
+
+		// a token without key id can only be verified by a single key
+		if kid == "" && len(j.keys) == 1 {
+			for _, key := range j.keys {
+				return key, true
+			}
+		}
+
+		return nil, false
+	}
+
+	key, ok := lookup()
+	if (!ok && time.Since(j.fetched) > jwksMinRefresh) || time.Since(j.fetched) > jwksRefreshInterval {
+		if err := j.load(ctx); err != nil {
+			slog.Error("Cannot refresh the jwks", "error", err.Error())
+		}
+		key, ok = lookup()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	return key, nil
+}
+
+// oidcVerifier authenticates the callers with tokens issued by an OIDC provider, like the ones of GitHub Actions or
+// GitLab CI, and authorizes them with the first rule that matches their claims.
+type oidcVerifier struct {
+	keys     *jwks
+	issuer   string
+	audience string
+	rules    []*OIDCRule
+}
+
+func loadOIDCRules(filename string) ([]*OIDCRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the oidc rules file: %w", err)
+	}
+
+	var rules []*OIDCRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOIDCRules, err)
+	}
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("%w: missing rule name", ErrInvalidOIDCRules)
+		}
+
+		if len(rule.Claims) == 0 {
+			return nil, fmt.Errorf("%w: rule %s has no claims", ErrInvalidOIDCRules, rule.Name)
+		}
+
+		if err := validateScopes(rule.Scopes); err != nil {
+			return nil, fmt.Errorf("%w: rule %s: %w", ErrInvalidOIDCRules, rule.Name, err)
+		}
+
+		for _, pattern := range rule.Claims {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%w: rule %s: invalid pattern %q: %w", ErrInvalidOIDCRules, rule.Name, pattern, err)
+			}
+		}
+
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("%w: rule %s: %w", ErrInvalidOIDCRules, rule.Name, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// newOIDCVerifier loads the keys from a jwks file or url, and the rules that authorize the callers.
+func newOIDCVerifier(ctx context.Context, source, issuer, audience, rulesFile string) (*oidcVerifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("the oidc issuer and audience are required")
+	}
+
+	if rulesFile == "" {
+		return nil, fmt.Errorf("%w: the oidc rules file is required", ErrInvalidOIDCRules)
+	}
+
+	rules, err := loadOIDCRules(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &jwks{source: source, client: &http.Client{Timeout: jwksFetchTimeout}}
+	if err := keys.load(ctx); err != nil {
+		return nil, err
+	}
+
+	return &oidcVerifier{keys: keys, issuer: issuer, audience: audience, rules: rules}, nil
+}
+
+// verify validates the signature, issuer, audience and expiration of the token, and returns the caller of the
+// first rule that matches its claims.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (Caller, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.key(ctx, kid)
+	},
+		jwt.WithIssuer(v.issuer),
+		jwt.WithAudience(v.audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(tokenLeeway),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+	)
+	if err != nil {
+		return Caller{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	subject, _ := claims.GetSubject()
+
+	for _, rule := range v.rules {
+		if rule.match(claims) {
+			return Caller{Identity: rule.Name + ":" + subject, Scopes: rule.Scopes, Access: &rule.AccessRule}, nil
+		}
+	}
+
+	return Caller{}, fmt.Errorf("%w: no rule matches the token of %s", ErrNotAllowed, subject)
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	test "github.com/stretchr/testify/assert"
+)
+
+const testOIDCRules = `[
+  {"name": "shop", "claims": {"repository": "acme/shop", "ref": "refs/heads/*"}, "scopes": ["update"], "stacks": ["shop"]}
+]`
+
+func encodeBigInt(value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
+
+func newTestJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	keys := []jsonWebKey{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: encodeBigInt(rsaKey.N), E: encodeBigInt(big.NewInt(int64(rsaKey.E)))},
+	}
+
+	if ecKey != nil {
+		keys = append(keys, jsonWebKey{Kty: "EC", Kid: "ec", Crv: "P-256", X: encodeBigInt(ecKey.X), Y: encodeBigInt(ecKey.Y)})
+	}
+
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+
+	return data
+}
+
+func newTestToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	assert := test.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+
+	dir := t.TempDir()
+	jwksFile := filepath.Join(dir, "jwks.json")
+	rulesFile := filepath.Join(dir, "rules.json")
+	assert.NoError(os.WriteFile(jwksFile, newTestJWKS(rsaKey, ecKey), 0o600))
+	assert.NoError(os.WriteFile(rulesFile, []byte(testOIDCRules), 0o600))
+
+	_, err = newOIDCVerifier(context.TODO(), jwksFile, "", "updater", rulesFile)
+	assert.Error(err)
+
+	verifier, err := newOIDCVerifier(context.TODO(), jwksFile, "https://issuer.example.com", "updater", rulesFile)
+	assert.NoError(err)
+
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		result := jwt.MapClaims{
+			"iss":        "https://issuer.example.com",
+			"aud":        "updater",
+			"sub":        "repo:acme/shop:ref:refs/heads/main",
+			"exp":        time.Now().Add(time.Minute).Unix(),
+			"repository": "acme/shop",
+			"ref":        "refs/heads/main",
+		}
+		for key, value := range changes {
+			result[key] = value
+		}
+
+		return result
+	}
+
+	caller, err := verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)))
+	assert.NoError(err)
+	assert.Equal("shop:repo:acme/shop:ref:refs/heads/main", caller.Identity)
+	assert.True(caller.hasScope(ScopeUpdate))
+	assert.False(caller.hasScope(ScopeRead))
+	assert.True(caller.Access.allows("shop_web", "shop", "nginx"))
+	assert.False(caller.Access.allows("blog_web", "blog", "nginx"))
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodES256, "ec", ecKey, claims(nil)))
+	assert.NoError(err)
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"aud": "other"})))
+	assert.ErrorIs(err, ErrInvalidToken)
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"iss": "https://evil.example.com"})))
+	assert.ErrorIs(err, ErrInvalidToken)
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})))
+	assert.ErrorIs(err, ErrInvalidToken)
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodES256, "rsa", ecKey, claims(nil)))
+	assert.ErrorIs(err, ErrInvalidToken)
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), claims(nil)))
+	assert.ErrorIs(err, ErrInvalidToken)
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"repository": "acme/blog"})))
+	assert.ErrorIs(err, ErrNotAllowed)
+
+	ts := httptest.NewServer(newServer(context.TODO(), &Swarm{}, &authenticator{keys: &keyStore{}, oidc: verifier}).echo(false))
+	defer ts.Close()
+
+	token := newTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil))
+	_, err = newRemoteClient(ts.URL, token).Services(context.TODO())
+	assert.ErrorContains(err, "doesn't have the read scope")
+
+	_, err = newRemoteClient(ts.URL, token+"x").Services(context.TODO())
+	assert.ErrorContains(err, "401")
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	assert := test.New(t)
+
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+
+	var mu sync.Mutex
+	current := newTestJWKS(oldKey, nil)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write(current)
+	}))
+	defer ts.Close()
+
+	rulesFile := filepath.Join(t.TempDir(), "rules.json")
+	assert.NoError(os.WriteFile(rulesFile, []byte(testOIDCRules), 0o600))
+
+	verifier, err := newOIDCVerifier(context.TODO(), ts.URL, "issuer", "updater", rulesFile)
+	assert.NoError(err)
+
+	claims := jwt.MapClaims{
+		"iss":        "issuer",
+		"aud":        "updater",
+		"exp":        time.Now().Add(time.Minute).Unix(),
+		"repository": "acme/shop",
+		"ref":        "refs/heads/main",
+	}
+
+	// the provider rotated its key, same key id
+	mu.Lock()
+	current = newTestJWKS(newKey, nil)
+	mu.Unlock()
+
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", newKey, claims))
+	assert.ErrorIs(err, ErrInvalidToken)
+
+	// the keys are fetched again once they are old enough
+	verifier.keys.fetched = time.Now().Add(-jwksRefreshInterval - time.Second)
+	_, err = verifier.verify(context.TODO(), newTestToken(t, jwt.SigningMethodRS256, "rsa", newKey, claims))
+	assert.NoError(err)
+}
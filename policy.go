@@ -0,0 +1,108 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+const strategyRolling = "rolling"
+
+// ServicePolicy is the update behavior configured by the labels of a service.
+type ServicePolicy struct {
+	Strategy         string              `json:"strategy"`
+	UpdateOnly       bool                `json:"updateOnly"`
+	CanaryReplicas   uint64              `json:"canaryReplicas,omitempty"`
+	CanarySoak       string              `json:"canarySoak,omitempty"`
+	BlueGreenLabels  []string            `json:"blueGreenLabels,omitempty"`
+	BlueGreenOld     string              `json:"blueGreenOld,omitempty"`
+	BlueGreenTimeout string              `json:"blueGreenTimeout,omitempty"`
+	UpdateConfig     *swarm.UpdateConfig `json:"updateConfig,omitempty"`
+	Credential       string              `json:"credential,omitempty"`
+}
+
+// serviceStrategy returns the update strategy selected by the labels of the service, rolling if it has none. The
+// update-only services can't use the blue/green strategy, as they have no tasks to move the traffic from.
+func serviceStrategy(labels map[string]string) (string, error) {
+	switch strategy := labels[strategyLabel]; strategy {
+	case "", strategyRolling:
+		return strategyRolling, nil
+	case strategyBlueGreen:
+		if strings.ToLower(labels[updateOnlyLabel]) == "true" {
+			return "", fmt.Errorf("the %s label can't be used with the %s strategy", updateOnlyLabel, strategyBlueGreen)
+		}
+
+		return strategyBlueGreen, nil
+	default:
+		return "", fmt.Errorf("invalid %s label: %s", strategyLabel, strategy)
+	}
+}
+
+// servicePolicy returns the effective update policy of the service from its labels.
+func servicePolicy(spec swarm.ServiceSpec) (ServicePolicy, error) {
+	policy := ServicePolicy{
+		Strategy:   strategyRolling,
+		UpdateOnly: strings.ToLower(spec.Labels[updateOnlyLabel]) == "true",
+	}
+
+	updateConfig, err := updateConfigOverrides(spec)
+	if err != nil {
+		return policy, err
+	}
+	policy.UpdateConfig = updateConfig
+
+	if credential, ok := spec.Labels[credentialLabel]; ok {
+		if err := validateCredentialName(credential); err != nil {
+			return policy, err
+		}
+		policy.Credential = credential
+	}
+
+	strategy, err := serviceStrategy(spec.Labels)
+	if err != nil {
+		return policy, err
+	}
+
+	if strategy == strategyBlueGreen {
+		config, err := blueGreenConfig(spec.Labels)
+		if err != nil {
+			return policy, err
+		}
+
+		policy.Strategy = strategyBlueGreen
+		policy.BlueGreenLabels = config.labels
+		policy.BlueGreenOld = config.old
+		policy.BlueGreenTimeout = config.timeout.String()
+
+		return policy, nil
+	}
+
+	replicas, soak, err := canaryConfig(spec.Labels)
+	if err != nil {
+		return policy, err
+	}
+
+	if replicas > 0 && !policy.UpdateOnly {
+		policy.CanaryReplicas = replicas
+		policy.CanarySoak = soak.String()
+	}
+
+	return policy, nil
+}
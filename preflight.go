@@ -0,0 +1,90 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// ErrPreflightFailed is returned when the swarm isn't healthy enough to start an update run.
+var ErrPreflightFailed = errors.New("preflight check failed")
+
+// preflight checks the health of the swarm nodes before any service is touched.
+func (c *Swarm) preflight(ctx context.Context) error {
+	nodes, err := c.client.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return fmt.Errorf("NodeList failed: %w", err)
+	}
+
+	var reasons []string
+	var managers, reachable, readyWorkers int
+
+	for _, node := range nodes {
+		name := node.Description.Hostname
+		if name == "" {
+			name = node.ID
+		}
+
+		if node.ManagerStatus != nil {
+			managers++
+			if node.ManagerStatus.Reachability == swarm.ReachabilityReachable {
+				reachable++
+			}
+		}
+
+		// drained nodes are expected to be down
+		if node.Status.State == swarm.NodeStateDown && node.Spec.Availability != swarm.NodeAvailabilityDrain {
+			reasons = append(reasons, fmt.Sprintf("node %s is down", name))
+		}
+
+		if node.Spec.Role == swarm.NodeRoleWorker &&
+			node.Status.State == swarm.NodeStateReady &&
+			node.Spec.Availability == swarm.NodeAvailabilityActive {
+			readyWorkers++
+		}
+	}
+
+	if managers == 0 || reachable <= managers/2 {
+		reasons = append(reasons, fmt.Sprintf("manager quorum lost (%d of %d managers reachable)", reachable, managers))
+	}
+
+	if readyWorkers < c.MinReadyWorkers {
+		reasons = append(reasons, fmt.Sprintf("only %d ready workers, %d required", readyWorkers, c.MinReadyWorkers))
+	}
+
+	if len(reasons) > 0 {
+		return fmt.Errorf("%w: %s", ErrPreflightFailed, strings.Join(reasons, ", "))
+	}
+
+	return nil
+}
+
+// updateInProgress reports if swarm is already rolling out or rolling back the service.
+func updateInProgress(service swarm.Service) bool {
+	if service.UpdateStatus == nil {
+		return false
+	}
+
+	return service.UpdateStatus.State == swarm.UpdateStateUpdating ||
+		service.UpdateStatus.State == swarm.UpdateStateRollbackStarted
+}
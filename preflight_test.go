@@ -0,0 +1,104 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	test "github.com/stretchr/testify/assert"
+)
+
+func newNode(id string, role swarm.NodeRole, state swarm.NodeState, reachability swarm.Reachability) swarm.Node {
+	node := swarm.Node{ID: id}
+	node.Spec.Role = role
+	node.Spec.Availability = swarm.NodeAvailabilityActive
+	node.Status.State = state
+	if role == swarm.NodeRoleManager {
+		node.ManagerStatus = &swarm.ManagerStatus{Reachability: reachability}
+	}
+
+	return node
+}
+
+func TestPreflight(t *testing.T) {
+	assert := test.New(t)
+
+	var nodes []swarm.Node
+	mock := dockerClientMock{}
+	mock.NodeListFn = func(_ context.Context, _ types.NodeListOptions) ([]swarm.Node, error) {
+		return nodes, nil
+	}
+
+	s := Swarm{client: &mock, Preflight: true}
+
+	nodes = []swarm.Node{
+		newNode("m1", swarm.NodeRoleManager, swarm.NodeStateReady, swarm.ReachabilityReachable),
+		newNode("m2", swarm.NodeRoleManager, swarm.NodeStateReady, swarm.ReachabilityReachable),
+		newNode("m3", swarm.NodeRoleManager, swarm.NodeStateReady, swarm.ReachabilityUnreachable),
+		newNode("w1", swarm.NodeRoleWorker, swarm.NodeStateReady, ""),
+	}
+	assert.NoError(s.preflight(context.TODO()))
+
+	s.MinReadyWorkers = 2
+	assert.ErrorIs(s.preflight(context.TODO()), ErrPreflightFailed)
+	s.MinReadyWorkers = 0
+
+	nodes[1].ManagerStatus.Reachability = swarm.ReachabilityUnreachable
+	assert.ErrorIs(s.preflight(context.TODO()), ErrPreflightFailed)
+	nodes[1].ManagerStatus.Reachability = swarm.ReachabilityReachable
+
+	nodes[3].Status.State = swarm.NodeStateDown
+	assert.ErrorIs(s.preflight(context.TODO()), ErrPreflightFailed)
+
+	nodes[3].Spec.Availability = swarm.NodeAvailabilityDrain
+	assert.NoError(s.preflight(context.TODO()))
+}
+
+func TestUpdateServicesPreflight(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{
+			{
+				ID:           "1",
+				UpdateStatus: &swarm.UpdateStatus{State: swarm.UpdateStateUpdating},
+				Spec: swarm.ServiceSpec{
+					Annotations:  swarm.Annotations{Name: "service_foo"},
+					TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "foo:latest"}},
+				},
+			},
+		}, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		assert.Fail("Service with an update in progress shouldn't be updated")
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1, Preflight: true}
+	_, err := s.UpdateServices(context.TODO())
+	assert.ErrorIs(err, ErrPreflightFailed)
+
+	mock.NodeListFn = func(_ context.Context, _ types.NodeListOptions) ([]swarm.Node, error) {
+		return []swarm.Node{newNode("m1", swarm.NodeRoleManager, swarm.NodeStateReady, swarm.ReachabilityReachable)}, nil
+	}
+	_, err = s.UpdateServices(context.TODO())
+	assert.NoError(err)
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	workFull     = "full"
+	workImages   = "images"
+	workServices = "services"
+)
+
+// workItem is an update run on the queue, shared by every request that was merged or deduplicated on it.
+type workItem struct {
+	job  *Job
+	req  *UpdateRequest
+	opts UpdateOptions
+	// key identifies the items with the same selection, caller and options
+	key string
+	// ready is when the item can start, it's delayed to merge the requests of the debounce window
+	ready time.Time
+	// started is when the item started running, zero while it's pending
+	started time.Time
+	// done is closed when the run finishes, the result and error can be read after that
+	done   chan struct{}
+	result *RunResult
+	err    error
+}
+
+// workKind returns if the options update every service, select them only by image or by name, stack or labels.
+func workKind(opts UpdateOptions) string {
+	switch {
+	case len(opts.Services) > 0 || len(opts.Stacks) > 0 || opts.LabelSelector != "":
+		return workServices
+	case len(opts.Images) > 0 || len(opts.Targets) > 0:
+		return workImages
+	default:
+		return workFull
+	}
+}
+
+// workKey returns the same key for the options that would run the same update.
+func workKey(opts UpdateOptions) string {
+	sorted := func(values []string) []string {
+		values = slices.Clone(values)
+		slices.Sort(values)
+
+		return values
+	}
+
+	data, _ := json.Marshal(struct {
+		Images        []string
+		Targets       []UpdateTarget
+		Services      []string
+		Stacks        []string
+		LabelSelector string
+		Force         bool
+		DryRun        bool
+		Identity      string
+	}{
+		sorted(opts.Images), opts.Targets, sorted(opts.Services), sorted(opts.Stacks),
+		opts.LabelSelector, opts.Force, opts.DryRun, opts.Caller.Identity,
+	})
+
+	return string(data)
+}
+
+// mergeable reports if the options only select services by image, the only updates that are merged.
+func mergeable(opts UpdateOptions) bool {
+	return workKind(opts) == workImages && len(opts.Targets) == 0 && !opts.DryRun
+}
+
+// wait returns when the run finishes or the context is done.
+func (w *workItem) wait(ctx context.Context) error {
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueueStatus is the number of update runs waiting on the queue and running.
+type QueueStatus struct {
+	Pending int `json:"pending"`
+	Running int `json:"running"`
+}
+
+// workQueue runs the updates of the schedule and the requests in order. The updates of every service run alone,
+// while the updates of selected services run in parallel, as the services that they share are updated one at a time.
+type workQueue struct {
+	swarm *Swarm
+	jobs  *jobStore
+	// debounce is how long the image updates of the callers with the same access are merged before running them,
+	// zero disables it
+	debounce time.Duration
+	// path is the file where the pending and running updates are saved, they are only kept in memory if empty
+	path    string
+	mu      sync.Mutex
+	pending []*workItem
+	running []*workItem
+	// exclusive is set while an update of every service is running
+	exclusive bool
+	closed    bool
+	wake      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func newWorkQueue(swarm *Swarm, jobs *jobStore) *workQueue {
+	q := &workQueue{swarm: swarm, jobs: jobs, wake: make(chan struct{}, 1)}
+	if swarm.DataDir != "" {
+		q.path = filepath.Join(swarm.DataDir, queueFile)
+	}
+
+	return q
+}
+
+// notify wakes up the dispatcher.
+func (q *workQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// submit adds an update to the queue. An identical pending update is returned instead, and the image updates are
+// merged into a pending update during the debounce window. Only the updates of callers with the same access rule are
+// merged, as they run with the access of the first one.
+func (q *workQueue) submit(trigger string, req *UpdateRequest, opts UpdateOptions) *workItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := workKey(opts)
+	now := time.Now()
+
+	for _, item := range q.pending {
+		if item.key == key {
+			return item
+		}
+
+		if req != nil && item.req != nil && mergeable(opts) && mergeable(item.opts) && now.Before(item.ready) &&
+			item.opts.Caller.Access.equal(opts.Caller.Access) && item.opts.Force == opts.Force {
+			for _, image := range opts.Images {
+				if !slices.Contains(item.opts.Images, image) {
+					item.opts.Images = append(item.opts.Images, image)
+				}
+			}
+			item.req.Images = item.opts.Images
+			item.key = workKey(item.opts)
+			q.jobs.join(item.job, opts.Caller.Identity)
+			q.save()
+
+			return item
+		}
+	}
+
+	item := &workItem{
+		job:   q.jobs.queue(trigger, opts.Caller.Identity),
+		opts:  opts,
+		key:   key,
+		ready: now,
+		done:  make(chan struct{}),
+	}
+
+	item.opts.Images = slices.Clone(opts.Images)
+	if req != nil {
+		// the request is shared with the merged ones, and saved on the job when it starts
+		item.req = new(UpdateRequest)
+		*item.req = *req
+		item.req.Images = item.opts.Images
+		item.req.Async = false
+	}
+
+	if q.debounce > 0 && mergeable(opts) && req != nil {
+		item.ready = now.Add(q.debounce)
+		time.AfterFunc(q.debounce, q.notify)
+	}
+
+	q.pending = append(q.pending, item)
+	q.save()
+	q.notify()
+
+	return item
+}
+
+// run starts the pending updates until the context is done.
+func (q *workQueue) run(ctx context.Context) {
+	for {
+		q.dispatch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+	}
+}
+
+// dispatch starts the pending updates that are ready, in order. An update of every service waits for the running
+// updates, and the updates behind it wait for it.
+func (q *workQueue) dispatch(ctx context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	started := false
+
+	for i := 0; i < len(q.pending) && !q.closed; {
+		item := q.pending[i]
+		full := workKind(item.opts) == workFull
+
+		if q.exclusive || (full && len(q.running) > 0) {
+			break
+		}
+
+		if now.Before(item.ready) {
+			i++
+			continue
+		}
+
+		q.pending = slices.Delete(q.pending, i, i+1)
+		q.running = append(q.running, item)
+		q.exclusive = full
+		q.wg.Add(1)
+
+		if item.started.IsZero() {
+			item.started = now
+		}
+
+		started = true
+
+		go q.execute(ctx, item)
+	}
+
+	if started {
+		q.save()
+	}
+}
+
+func (q *workQueue) execute(ctx context.Context, item *workItem) {
+	defer q.wg.Done()
+
+	slog.Debug("Starting queued update", "job", item.job.ID, "kind", workKind(item.opts),
+		"identity", item.opts.Caller.Identity)
+
+	q.jobs.run(item.job, item.req)
+
+	item.result, item.err = q.swarm.Update(ctx, item.opts)
+	q.jobs.finish(item.job, item.result, item.err)
+
+	if item.err != nil {
+		slog.Error("Failed to update services", "job", item.job.ID, "error", item.err.Error())
+	}
+
+	q.mu.Lock()
+	q.running = slices.DeleteFunc(q.running, func(other *workItem) bool { return other == item })
+	if workKind(item.opts) == workFull {
+		q.exclusive = false
+	}
+	q.save()
+	q.mu.Unlock()
+
+	close(item.done)
+	q.notify()
+}
+
+// status returns the number of pending and running updates.
+func (q *workQueue) status() QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QueueStatus{Pending: len(q.pending), Running: len(q.running)}
+}
+
+// close stops starting the pending updates and waits for the running ones.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+// serviceLocks serializes the operations on each service, so the runs that update different services can run in
+// parallel.
+type serviceLocks struct {
+	mu   sync.Mutex
+	busy map[string]chan struct{}
+}
+
+// lock waits until no other operation is using the service, and reports if it had to wait.
+func (l *serviceLocks) lock(ctx context.Context, id string) (bool, error) {
+	waited := false
+
+	for {
+		l.mu.Lock()
+		released, busy := l.busy[id]
+		if !busy {
+			if l.busy == nil {
+				l.busy = map[string]chan struct{}{}
+			}
+			l.busy[id] = make(chan struct{})
+			l.mu.Unlock()
+
+			return waited, nil
+		}
+		l.mu.Unlock()
+
+		waited = true
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return waited, ctx.Err()
+		}
+	}
+}
+
+func (l *serviceLocks) unlock(id string) {
+	l.mu.Lock()
+	released := l.busy[id]
+	delete(l.busy, id)
+	l.mu.Unlock()
+
+	close(released)
+}
@@ -0,0 +1,317 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestMergedUpdates(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name, image string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: image}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	services := func() []swarm.Service {
+		return []swarm.Service{
+			newService("web", "mycompany/web:latest"),
+			newService("api", "mycompany/api:latest"),
+			newService("worker", "mycompany/worker:latest"),
+		}
+	}
+
+	var runs atomic.Int32
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		runs.Add(1)
+		return services(), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		for _, service := range services() {
+			if service.ID == serviceID {
+				return service, nil, nil
+			}
+		}
+
+		return swarm.Service{}, nil, nil
+	}
+
+	keys, err := newKeyStore("secret", "")
+	assert.NoError(err)
+
+	srv := newServer(context.TODO(), &Swarm{client: &mock, MaxThreads: 1}, &authenticator{keys: keys})
+	srv.queue.debounce = 200 * time.Millisecond
+	ts := httptest.NewServer(srv.echo(false))
+	defer ts.Close()
+
+	remote := newRemoteClient(ts.URL, "secret")
+
+	var wg sync.WaitGroup
+	responses := make([]*UpdateResponse, 2)
+	for i, image := range []string{"mycompany/web", "mycompany/api"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := remote.Update(context.TODO(), UpdateRequest{Images: []string{image}})
+			assert.NoError(err)
+			responses[i] = response
+		}()
+	}
+
+	// an async request within the window joins the same job
+	time.Sleep(50 * time.Millisecond)
+	async, err := remote.Update(context.TODO(), UpdateRequest{Images: []string{"mycompany/web"}, Async: true})
+	assert.NoError(err)
+	assert.Equal("accepted", async.Status)
+
+	job, err := remote.Job(context.TODO(), async.Job)
+	assert.NoError(err)
+	assert.Equal(JobPending, job.Status)
+
+	wg.Wait()
+
+	assert.Equal(int32(1), runs.Load())
+	assert.Equal(async.Job, responses[0].Job)
+	assert.Equal(async.Job, responses[1].Job)
+	assert.Equal(responses[0].Services, responses[1].Services)
+
+	updated := map[string]string{}
+	for _, result := range responses[0].Services {
+		updated[result.Service] = result.Status
+	}
+	assert.Equal(map[string]string{"web": StatusUpdated, "api": StatusUpdated}, updated)
+
+	job, err = remote.Job(context.TODO(), async.Job)
+	assert.NoError(err)
+	assert.Equal(JobDone, job.Status)
+	assert.ElementsMatch([]string{"mycompany/web", "mycompany/api"}, job.Request.Images)
+
+	// the requests that select services by name aren't merged
+	response, err := remote.Update(context.TODO(), UpdateRequest{Services: []string{"worker"}})
+	assert.NoError(err)
+	assert.NotEqual(async.Job, response.Job)
+	assert.Equal(int32(2), runs.Load())
+}
+
+func TestMergedCallers(t *testing.T) {
+	assert := test.New(t)
+
+	scoped := func(image string) *AccessRule {
+		rule := &AccessRule{Images: []string{image}}
+		assert.NoError(rule.compile())
+
+		return rule
+	}
+
+	q := newWorkQueue(&Swarm{}, &jobStore{})
+	q.debounce = time.Hour
+
+	submit := func(identity string, access *AccessRule, image string) *workItem {
+		req := &UpdateRequest{Images: []string{image}}
+		opts := req.options()
+		opts.Caller = Caller{Identity: identity, Access: access}
+
+		return q.submit(jobRequest, req, opts)
+	}
+
+	// the callers without restrictions share a run, and so do the ones with the same access rule
+	ci := submit("ci", nil, "mycompany/web")
+	admin := submit("admin", &AccessRule{}, "mycompany/api")
+	deploy := submit("deploy", scoped("mycompany/*"), "mycompany/worker")
+	release := submit("release", scoped("mycompany/*"), "mycompany/cron")
+	other := submit("other", scoped("other/*"), "mycompany/db")
+
+	assert.Same(ci, admin)
+	assert.Same(deploy, release)
+	assert.NotSame(ci, deploy)
+	assert.NotSame(deploy, other)
+	assert.Equal([]string{"mycompany/web", "mycompany/api"}, ci.opts.Images)
+	assert.Equal([]string{"mycompany/worker", "mycompany/cron"}, deploy.opts.Images)
+
+	// every merged caller can see the pending job as its own
+	assert.Equal("ci", ci.job.Identity)
+	assert.Equal([]string{"admin"}, ci.job.Callers)
+	_, ok := visibleJob(Caller{Identity: "release", Access: scoped("mycompany/*")}, *deploy.job)
+	assert.True(ok)
+	_, ok = visibleJob(Caller{Identity: "other", Access: scoped("mycompany/*")}, *deploy.job)
+	assert.False(ok)
+}
+
+func TestWorkQueue(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "mycompany/" + name + ":latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var blocked atomic.Bool
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{newService("web"), newService("api")}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return newService(serviceID), nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		// the first update of web waits until it's released
+		if serviceID == "web" && blocked.CompareAndSwap(false, true) {
+			close(started)
+			<-release
+		}
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := &jobStore{}
+	queue := newWorkQueue(&Swarm{client: &mock, MaxThreads: 2}, jobs)
+	go queue.run(ctx)
+
+	web := queue.submit(jobRequest, nil, UpdateOptions{Services: []string{"web"}, Caller: Caller{Identity: "ci"}})
+	<-started
+
+	// a service that isn't being updated doesn't wait for the other run
+	api := queue.submit(jobRequest, nil, UpdateOptions{Services: []string{"api"}, Caller: Caller{Identity: "ci"}})
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	assert.NoError(api.wait(waitCtx))
+	assert.NoError(api.err)
+	assert.Equal(StatusUpdated, api.result.Services[0].Status)
+
+	// the update of every service waits for the running ones, and identical pending updates are merged
+	full := queue.submit(jobScheduled, nil, UpdateOptions{Caller: Caller{Identity: jobScheduled}})
+	assert.Same(full, queue.submit(jobScheduled, nil, UpdateOptions{Caller: Caller{Identity: jobScheduled}}))
+
+	// the updates behind it wait for it, even on services that aren't being updated
+	next := queue.submit(jobRequest, nil, UpdateOptions{Services: []string{"api"}, Caller: Caller{Identity: "ci"}})
+	assert.NotSame(api, next)
+	assert.Equal(QueueStatus{Pending: 2, Running: 1}, queue.status())
+
+	job, ok := jobs.get(full.job.ID)
+	assert.True(ok)
+	assert.Equal(JobPending, job.Status)
+
+	close(release)
+
+	for _, item := range []*workItem{web, full, next} {
+		assert.NoError(item.wait(waitCtx))
+		assert.NoError(item.err)
+	}
+
+	assert.Len(full.result.Services, 2)
+	assert.Equal(QueueStatus{}, queue.status())
+
+	queue.close()
+	closed := queue.submit(jobScheduled, nil, UpdateOptions{Caller: Caller{Identity: jobScheduled}})
+	queue.notify()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(QueueStatus{Pending: 1}, queue.status())
+	assert.Equal(JobPending, closed.job.Status)
+}
+
+func TestServiceLocks(t *testing.T) {
+	assert := test.New(t)
+
+	locks := serviceLocks{}
+
+	waited, err := locks.lock(context.TODO(), "web")
+	assert.NoError(err)
+	assert.False(waited)
+
+	waited, err = locks.lock(context.TODO(), "api")
+	assert.NoError(err)
+	assert.False(waited)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(ctx, "web")
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		locks.unlock("web")
+	}()
+
+	waited, err = locks.lock(context.TODO(), "web")
+	assert.NoError(err)
+	assert.True(waited)
+}
+
+func TestLockedUpdateInspectError(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, _ string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return swarm.Service{}, nil, errors.New("service web not found")
+	}
+
+	s := &Swarm{client: &mock}
+
+	service := swarm.Service{ID: "web"}
+	service.Spec.Name = "shop_web"
+	service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest"}
+
+	// another run is updating the service
+	_, err := s.locks.lock(context.TODO(), service.ID)
+	assert.NoError(err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.locks.unlock(service.ID)
+	}()
+
+	result := s.runLockedUpdate(context.TODO(), service, imageTarget{})
+	assert.Equal(StatusFailed, result.Status)
+	assert.Equal("shop_web", result.Service)
+	assert.Equal("service web not found", result.Error)
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// quotaBackoff is how long a registry is deferred when its quota is low and the refill rate is unknown
+const quotaBackoff = time.Minute
+
+// registryQuota is the pull quota of a registry, from the RateLimit-Limit and RateLimit-Remaining headers.
+type registryQuota struct {
+	limit     int
+	remaining int
+	// window is the time that it takes to refill the limit
+	window time.Duration
+}
+
+// parseRateLimit parses a RateLimit header value like 100;w=21600, where w is the window in seconds.
+func parseRateLimit(value string) (int, time.Duration, bool) {
+	count, params, _ := strings.Cut(value, ";")
+
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var window time.Duration
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.TrimSpace(key) == "w" {
+			if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return n, window, true
+}
+
+// quotaFromResponse reads the pull quota of the response, a 429 response has no quota left even without headers.
+func quotaFromResponse(resp *http.Response) (registryQuota, bool) {
+	var quota registryQuota
+	var ok bool
+
+	quota.remaining, quota.window, ok = parseRateLimit(resp.Header.Get("RateLimit-Remaining"))
+	if ok {
+		quota.limit, _, _ = parseRateLimit(resp.Header.Get("RateLimit-Limit"))
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		quota.remaining = 0
+		ok = true
+	}
+
+	return quota, ok
+}
+
+// backoff is how long it takes to refill the quota above the reserve.
+func (q registryQuota) backoff(reserve int) time.Duration {
+	if q.limit <= 0 || q.window <= 0 {
+		return quotaBackoff
+	}
+
+	return q.window / time.Duration(q.limit) * time.Duration(reserve-q.remaining+1)
+}
+
+// registryStatus is what is known of a registry, shared by the runs.
+type registryStatus struct {
+	// slots limits the concurrent lookups on the registry
+	slots chan struct{}
+	quota registryQuota
+	// known is set if the quota was read from the registry, remaining is decreased by every lookup after that
+	known bool
+	// deferredUntil is when the services of the registry are resolved again after the quota ran low
+	deferredUntil time.Time
+	// probed is the last run that read the quota
+	probed  uint64
+	breaker circuitBreaker
+}
+
+// registryState keeps the status of the registries by domain.
+type registryState struct {
+	mu    sync.Mutex
+	hosts map[string]*registryStatus
+}
+
+// status returns the status of the registry, it must be called with the lock held.
+func (r *registryState) status(domain string) *registryStatus {
+	if r.hosts == nil {
+		r.hosts = map[string]*registryStatus{}
+	}
+
+	status, ok := r.hosts[domain]
+	if !ok {
+		status = &registryStatus{}
+		r.hosts[domain] = status
+	}
+
+	return status
+}
+
+// acquire waits until there are less than limit lookups running on the registry, there is no limit if it's zero.
+func (r *registryState) acquire(ctx context.Context, domain string, limit int) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	r.mu.Lock()
+	status := r.status(domain)
+	if status.slots == nil {
+		status.slots = make(chan struct{}, limit)
+	}
+	slots := status.slots
+	r.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// consume counts a lookup against the known quota of the registry.
+func (r *registryState) consume(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if status := r.status(domain); status.known && status.quota.remaining > 0 {
+		status.quota.remaining--
+	}
+}
+
+// shouldProbe reports if the quota of the registry wasn't read by the run, and it isn't deferred.
+func (r *registryState) shouldProbe(domain string, run uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status(domain)
+	if status.probed == run || time.Now().Before(status.deferredUntil) {
+		return false
+	}
+
+	status.probed = run
+
+	return true
+}
+
+func (r *registryState) setQuota(domain string, quota registryQuota) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status(domain)
+	status.quota = quota
+	status.known = true
+}
+
+// deferred reports if the lookups on the registry should wait, as its quota is at or below the reserve, and until
+// when.
+func (r *registryState) deferred(domain string, reserve int) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status(domain)
+	now := time.Now()
+
+	if now.Before(status.deferredUntil) {
+		return status.deferredUntil, true
+	}
+
+	if !status.known || status.quota.remaining > reserve {
+		return time.Time{}, false
+	}
+
+	status.deferredUntil = now.Add(status.quota.backoff(reserve))
+	// the quota is read again when the registry is used next
+	status.known = false
+
+	return status.deferredUntil, true
+}
+
+// imageDomain returns the registry domain of the image, empty if the name is invalid.
+func imageDomain(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+
+	return reference.Domain(named)
+}
+
+// pendingUpdate is a service selected by a run, with what should be deployed on it.
+type pendingUpdate struct {
+	service swarm.Service
+	target  imageTarget
+}
+
+// prefetchEnabled reports if the images are resolved before the updates, to limit the lookups of each registry.
+func (c *Swarm) prefetchEnabled() bool {
+	return c.RegistryConcurrency > 0 || c.QuotaReserve > 0
+}
+
+// prefetch resolves the images of the services before updating them, with a separate set of workers for every
+// registry, so a slow registry only delays its own services. Every service is passed to start as soon as its image is
+// resolved, while the lookups of the other services go on. The results of the services that were deferred, as the
+// quota of their registry is low, or whose image couldn't be resolved, are returned by service ID.
+func (c *Swarm) prefetch(ctx context.Context, run uint64, updates []pendingUpdate, start func(pendingUpdate)) map[string]ServiceResult {
+	groups := map[string][]pendingUpdate{}
+	for _, update := range updates {
+		domain := imageDomain(update.service.Spec.TaskTemplate.ContainerSpec.Image)
+		groups[domain] = append(groups[domain], update)
+	}
+
+	workers := c.RegistryConcurrency
+	if workers <= 0 {
+		workers = max(c.MaxThreads, 1)
+	}
+
+	results := map[string]ServiceResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for domain, group := range groups {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			c.probeQuota(ctx, run, domain, group[0])
+
+			queue := make(chan pendingUpdate)
+			var pool sync.WaitGroup
+
+			for range min(workers, len(group)) {
+				pool.Add(1)
+
+				go func() {
+					defer pool.Done()
+
+					for update := range queue {
+						result, done := c.prefetchImage(ctx, domain, update)
+						if !done {
+							start(update)
+							continue
+						}
+
+						mu.Lock()
+						results[update.service.ID] = result
+						mu.Unlock()
+					}
+				}()
+			}
+
+			for _, update := range group {
+				queue <- update
+			}
+
+			close(queue)
+			pool.Wait()
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// prefetchImage resolves the image of the service, so the update finds it on the digest cache. It returns the result
+// of the service if it shouldn't be updated.
+func (c *Swarm) prefetchImage(ctx context.Context, domain string, update pendingUpdate) (ServiceResult, bool) {
+	image := update.service.Spec.TaskTemplate.ContainerSpec.Image
+
+	if c.QuotaReserve > 0 {
+		if until, deferred := c.registries.deferred(domain, c.QuotaReserve); deferred {
+			slog.Warn("Deferring service, the registry pull quota is low",
+				"service", update.service.Spec.Name, "registry", domain, "until", until.Format(time.RFC3339))
+
+			result := serviceResult(update.service)
+			result.Status = StatusRateLimited
+			result.Reason = fmt.Sprintf("%s pull quota is low, deferred until %s", domain, until.Format(time.RFC3339))
+
+			return result, true
+		}
+	}
+
+	if _, _, err := c.resolveImage(ctx, image, update.target); err != nil {
+		result := serviceResult(update.service)
+		c.failed(ctx, &result, err)
+
+		return result, true
+	}
+
+	return ServiceResult{}, false
+}
+
+// probeQuota reads the pull quota of the registry once per run, with the image of one of its services.
+func (c *Swarm) probeQuota(ctx context.Context, run uint64, domain string, update pendingUpdate) {
+	if c.QuotaReserve <= 0 || !c.registries.shouldProbe(domain, run) {
+		return
+	}
+
+	image := update.service.Spec.TaskTemplate.ContainerSpec.Image
+
+	encodedAuth, err := c.registryAuth(ctx, image, update.target.credential)
+	if err != nil {
+		return
+	}
+
+	imageName, err := update.target.targetImage(strings.Split(image, "@sha")[0])
+	if err != nil {
+		return
+	}
+
+	resp, err := c.registryClient().headManifest(ctx, imageName, encodedAuth)
+	if err != nil {
+		slog.Debug("Cannot read the registry pull quota", "registry", domain, "error", err)
+		return
+	}
+
+	quota, ok := quotaFromResponse(resp)
+	if !ok {
+		return
+	}
+
+	slog.Debug("Registry pull quota", "registry", domain, "remaining", quota.remaining, "limit", quota.limit)
+	c.registries.setQuota(domain, quota)
+}
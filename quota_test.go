@@ -0,0 +1,256 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	assert := test.New(t)
+
+	count, window, ok := parseRateLimit("100;w=21600")
+	assert.True(ok)
+	assert.Equal(100, count)
+	assert.Equal(6*time.Hour, window)
+
+	count, window, ok = parseRateLimit("76")
+	assert.True(ok)
+	assert.Equal(76, count)
+	assert.Zero(window)
+
+	_, _, ok = parseRateLimit("")
+	assert.False(ok)
+
+	quota := registryQuota{limit: 100, remaining: 5, window: 6 * time.Hour}
+	assert.Equal(6*time.Hour/100*6, quota.backoff(10))
+	assert.Equal(quotaBackoff, registryQuota{}.backoff(10))
+}
+
+func newImageServices(images ...string) []swarm.Service {
+	var services []swarm.Service
+	for i, image := range images {
+		service := swarm.Service{ID: fmt.Sprintf("service%d", i)}
+		service.Spec.Name = service.ID
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: image}
+		services = append(services, service)
+	}
+
+	return services
+}
+
+func TestQuotaDeferral(t *testing.T) {
+	assert := test.New(t)
+
+	var probes atomic.Int32
+	limited := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodHead, r.Method)
+		probes.Add(1)
+		w.Header().Set("RateLimit-Limit", "100;w=21600")
+		w.Header().Set("RateLimit-Remaining", "3;w=21600")
+	})
+	// a registry without rate limits
+	unlimited := newTestRegistry(t, func(_ http.ResponseWriter, _ *http.Request) {})
+
+	limitedHost := strings.TrimPrefix(limited.URL, "https://")
+	unlimitedHost := strings.TrimPrefix(unlimited.URL, "https://")
+
+	var images []string
+	for i := range 5 {
+		images = append(images, fmt.Sprintf("%s/mycompany/web%d:latest", limitedHost, i))
+	}
+	images = append(images, unlimitedHost+"/mycompany/api:latest")
+
+	var inspects sync.Map
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return newImageServices(images...), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, image, _ string) (registry.DistributionInspect, error) {
+		inspects.Store(image, true)
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+
+	// both test registries use the same certificate
+	s := &Swarm{client: &mock, MaxThreads: 1, RegistryConcurrency: 1, QuotaReserve: 1,
+		registry: &registryClient{client: limited.Client()}}
+
+	statuses := func(run *RunResult) map[string]string {
+		statuses := map[string]string{}
+		for _, service := range run.Services {
+			statuses[service.Service] = service.Status
+		}
+
+		return statuses
+	}
+
+	run, err := s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"service0": StatusOutdated,
+		"service1": StatusOutdated,
+		"service2": StatusRateLimited,
+		"service3": StatusRateLimited,
+		"service4": StatusRateLimited,
+		"service5": StatusOutdated,
+	}, statuses(run))
+	assert.Equal(int32(1), probes.Load())
+
+	_, found := inspects.Load(images[2])
+	assert.False(found)
+
+	// the registry is deferred until the quota is refilled, without probing it again
+	run, err = s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Equal(StatusRateLimited, statuses(run)["service0"])
+	assert.Equal(StatusOutdated, statuses(run)["service5"])
+	assert.Equal(int32(1), probes.Load())
+
+	for _, service := range run.Services {
+		if service.Status == StatusRateLimited {
+			assert.Contains(service.Reason, "pull quota is low")
+		}
+	}
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	assert := test.New(t)
+
+	var images []string
+	for i := range 3 {
+		images = append(images, fmt.Sprintf("slow.local/app%d", i), fmt.Sprintf("fast.local/app%d", i))
+	}
+
+	var mu sync.Mutex
+	running := map[string]int{}
+	peak := map[string]int{}
+	var fast atomic.Int32
+	fastDone := make(chan struct{})
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return newImageServices(images...), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, image, _ string) (registry.DistributionInspect, error) {
+		domain := imageDomain(image)
+
+		mu.Lock()
+		running[domain]++
+		peak[domain] = max(peak[domain], running[domain])
+		mu.Unlock()
+
+		if domain == "slow.local" {
+			// the slow registry answers after the fast one resolved all its images
+			select {
+			case <-fastDone:
+			case <-time.After(5 * time.Second):
+			}
+		} else if fast.Add(1) == 3 {
+			close(fastDone)
+		}
+
+		mu.Lock()
+		running[domain]--
+		mu.Unlock()
+
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1, RegistryConcurrency: 1}
+
+	start := time.Now()
+	run, err := s.Update(context.TODO(), UpdateOptions{DryRun: true})
+	assert.NoError(err)
+	assert.Less(time.Since(start), 5*time.Second)
+	assert.Len(run.Services, 6)
+	assert.Equal(map[string]int{"slow.local": 1, "fast.local": 1}, peak)
+
+	for _, service := range run.Services {
+		assert.Equal(StatusOutdated, service.Status)
+	}
+}
+
+func TestPrefetchStartsUpdates(t *testing.T) {
+	assert := test.New(t)
+
+	var images []string
+	for i := range 3 {
+		images = append(images, fmt.Sprintf("slow.local/app%d", i), fmt.Sprintf("fast.local/app%d", i))
+	}
+
+	var updated sync.Map
+
+	var fast atomic.Int32
+	fastDone := make(chan struct{})
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return newImageServices(images...), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, image, _ string) (registry.DistributionInspect, error) {
+		if imageDomain(image) == "slow.local" {
+			// the slow registry answers after the services of the fast one were updated
+			select {
+			case <-fastDone:
+			case <-time.After(5 * time.Second):
+			}
+		}
+
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		spec, _ := updated.Load(serviceID)
+		return swarm.Service{ID: serviceID, Spec: spec.(swarm.ServiceSpec), PreviousSpec: &swarm.ServiceSpec{
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}},
+		}}, nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, service swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updated.Store(serviceID, service)
+		if imageDomain(service.TaskTemplate.ContainerSpec.Image) == "fast.local" && fast.Add(1) == 3 {
+			close(fastDone)
+		}
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 2, RegistryConcurrency: 1}
+
+	start := time.Now()
+	run, err := s.Update(context.TODO(), UpdateOptions{})
+	assert.NoError(err)
+	assert.Less(time.Since(start), 5*time.Second)
+	assert.Len(run.Services, 6)
+
+	for _, service := range run.Services {
+		assert.Equal(StatusUpdated, service.Status, service.Service)
+	}
+}
@@ -0,0 +1,391 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	registryTimeout   = 10 * time.Second
+	// registryClientID is the OAuth2 client id sent when exchanging an identity token, like the docker daemon
+	registryClientID = "docker"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// RegistryOptions configures how the registries are reached, like the insecure registries and the certs.d directory
+// of the docker daemon. They apply to the registry mirrors too.
+type RegistryOptions struct {
+	// Insecure are the registry hosts, like mirror.local:5000, that are reached over plain http
+	Insecure []string
+	// CertsDir has the <host>/*.crt CA bundles and the <host>/*.cert and *.key client certificates of the registries,
+	// like /etc/docker/certs.d
+	CertsDir string
+}
+
+// registryClient sends requests straight to the registries, for the information that the docker daemon doesn't
+// return, like the headers of the responses.
+type registryClient struct {
+	client   *http.Client
+	insecure map[string]bool
+	certsDir string
+
+	mu sync.Mutex
+	// clients with the certificates of the registries that have them on the certs directory, by host
+	clients map[string]*http.Client
+}
+
+func newRegistryClient(opts RegistryOptions) *registryClient {
+	insecure := map[string]bool{}
+	for _, host := range opts.Insecure {
+		insecure[strings.TrimSpace(host)] = true
+	}
+
+	return &registryClient{
+		client:   &http.Client{Timeout: registryTimeout},
+		insecure: insecure,
+		certsDir: opts.CertsDir,
+		clients:  map[string]*http.Client{},
+	}
+}
+
+var defaultRegistryClient = newRegistryClient(RegistryOptions{})
+
+// registryClient returns the client used to send requests straight to the registries.
+func (c *Swarm) registryClient() *registryClient {
+	if c.registry == nil {
+		return defaultRegistryClient
+	}
+
+	return c.registry
+}
+
+// registryHost returns the host of the registry of the image, the docker.io images are served by
+// registry-1.docker.io.
+func registryHost(named reference.Named) string {
+	domain := reference.Domain(named)
+	if domain == dockerHubDomain {
+		return dockerHubRegistry
+	}
+
+	return domain
+}
+
+// clientFor returns the client of the registry host, which trusts the CA bundles and sends the client certificates of
+// its certs directory, if it has one. The certificates are loaded once.
+func (r *registryClient) clientFor(host string) (*http.Client, error) {
+	if r.certsDir == "" {
+		return r.client, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client, ok := r.clients[host]; ok {
+		return client, nil
+	}
+
+	dir := filepath.Join(r.certsDir, host)
+	cas, _ := filepath.Glob(filepath.Join(dir, "*.crt"))
+	certs, _ := filepath.Glob(filepath.Join(dir, "*.cert"))
+
+	client := r.client
+	if len(cas) > 0 || len(certs) > 0 {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if len(cas) > 0 {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+
+			for _, ca := range cas {
+				data, err := os.ReadFile(ca)
+				if err != nil {
+					return nil, fmt.Errorf("cannot read the CA bundle of registry %s: %w", host, err)
+				}
+
+				if !pool.AppendCertsFromPEM(data) {
+					return nil, fmt.Errorf("no certificates found on %s", ca)
+				}
+			}
+
+			config.RootCAs = pool
+		}
+
+		for _, cert := range certs {
+			pair, err := tls.LoadX509KeyPair(cert, strings.TrimSuffix(cert, ".cert")+".key")
+			if err != nil {
+				return nil, fmt.Errorf("cannot load the client certificate of registry %s: %w", host, err)
+			}
+
+			config.Certificates = append(config.Certificates, pair)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client = &http.Client{Timeout: r.client.Timeout, Transport: transport}
+	}
+
+	r.clients[host] = client
+
+	return client, nil
+}
+
+// headManifest sends a HEAD request for the manifest of the image, authenticating with a bearer token if the
+// registry asks for one. The manifest isn't downloaded, so Docker Hub doesn't count it as a pull. The insecure
+// registries are reached over plain http.
+func (r *registryClient) headManifest(ctx context.Context, image, encodedAuth string) (*http.Response, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	ref := "latest"
+	if canonical, ok := named.(reference.Canonical); ok {
+		ref = canonical.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+
+	host := registryHost(named)
+	scheme := "https"
+	if r.insecure[host] {
+		scheme = "http"
+	}
+
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, reference.Path(named), ref)
+
+	resp, err := r.head(ctx, manifestURL, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	token, err := r.token(ctx, resp.Header.Get("WWW-Authenticate"), encodedAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.head(ctx, manifestURL, token)
+}
+
+func (r *registryClient) head(ctx context.Context, manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client, err := r.clientFor(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// only the headers are used
+	_ = resp.Body.Close()
+
+	return resp, nil
+}
+
+// manifestDigest returns the digest of the manifest of the image, from the Docker-Content-Digest header. The
+// status codes of the registry are returned as the docker errors of the same class.
+func (r *registryClient) manifestDigest(ctx context.Context, image, encodedAuth string) (digest.Digest, error) {
+	resp, err := r.headManifest(ctx, image, encodedAuth)
+	if err != nil {
+		return "", err
+	}
+
+	status := fmt.Errorf("registry returned %s for %s", resp.Status, image)
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err != nil {
+			return "", fmt.Errorf("registry returned an invalid digest for %s: %w", image, err)
+		}
+
+		return dgst, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return "", errdefs.NotFound(status)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", errdefs.Unauthorized(status)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "", errdefs.Unavailable(status)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return "", errdefs.System(status)
+	default:
+		return "", status
+	}
+}
+
+// token requests a bearer token from the realm of the challenge, with the credentials of the encoded auth if any. An
+// identity token is exchanged for an access token with the OAuth2 refresh token grant, like the docker daemon does.
+func (r *registryClient) token(ctx context.Context, challenge, encodedAuth string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid authentication realm: %w", err)
+	}
+
+	auth := &registry.AuthConfig{}
+	if encodedAuth != "" {
+		auth, err = registry.DecodeAuthConfig(encodedAuth)
+		if err != nil {
+			return "", fmt.Errorf("invalid registry auth: %w", err)
+		}
+	}
+
+	if auth.RegistryToken != "" {
+		return auth.RegistryToken, nil
+	}
+
+	values := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			values.Set(key, params[key])
+		}
+	}
+
+	var req *http.Request
+	if auth.IdentityToken != "" {
+		values.Set("grant_type", "refresh_token")
+		values.Set("refresh_token", auth.IdentityToken)
+		values.Set("client_id", registryClientID)
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(values.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		for key := range values {
+			query.Set(key, values.Get(key))
+		}
+		realm.RawQuery = query.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+
+	client, err := r.clientFor(realm.Host)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", errdefs.Unauthorized(fmt.Errorf("token request failed with status %d", resp.StatusCode))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("cannot parse the token response: %w", err)
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+
+	return body.AccessToken, nil
+}
+
+// parseChallenge returns the scheme and parameters of a WWW-Authenticate header, the quoted values may have commas.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+	}
+
+	return scheme, params
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestParseChallenge(t *testing.T) {
+	assert := test.New(t)
+
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	assert.Equal("Bearer", scheme)
+	assert.Equal(map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull,push",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal("Basic", scheme)
+	assert.Equal(map[string]string{"realm": "registry"}, params)
+}
+
+// newTestRegistry returns a registry that requires a bearer token for the manifests, issued with the user and
+// password credentials.
+func newTestRegistry(t *testing.T, manifest http.HandlerFunc) *httptest.Server {
+	var ts *httptest.Server
+
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if user, password, ok := r.BasicAuth(); ok && (user != "user" || password != "password") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"secret-token"}`))
+		case strings.HasPrefix(r.URL.Path, "/v2/"):
+			if r.Header.Get("Authorization") != "Bearer secret-token" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+ts.URL+`/token",service="test",scope="repository:mycompany/web:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			manifest(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestHeadManifest(t *testing.T) {
+	assert := test.New(t)
+
+	var path string
+	ts := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Docker-Content-Digest", newDigest)
+	})
+
+	client := &registryClient{client: ts.Client()}
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	resp, err := client.headManifest(context.TODO(), host+"/mycompany/web:1.0", "")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(newDigest, resp.Header.Get("Docker-Content-Digest"))
+	assert.Equal("/v2/mycompany/web/manifests/1.0", path)
+
+	auth, err := registry.EncodeAuthConfig(registry.AuthConfig{Username: "user", Password: "password"})
+	assert.NoError(err)
+
+	_, err = client.headManifest(context.TODO(), host+"/mycompany/web", auth)
+	assert.NoError(err)
+	assert.Equal("/v2/mycompany/web/manifests/latest", path)
+
+	auth, err = registry.EncodeAuthConfig(registry.AuthConfig{Username: "user", Password: "wrong"})
+	assert.NoError(err)
+
+	_, err = client.headManifest(context.TODO(), host+"/mycompany/web", auth)
+	assert.Error(err)
+}
+
+func TestRegistryOptions(t *testing.T) {
+	assert := test.New(t)
+
+	manifest := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Docker-Content-Digest", newDigest)
+	})
+
+	plain := httptest.NewServer(manifest)
+	t.Cleanup(plain.Close)
+	secure := httptest.NewTLSServer(manifest)
+	t.Cleanup(secure.Close)
+
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	secureHost := strings.TrimPrefix(secure.URL, "https://")
+
+	// the CA of the test server is only trusted from the certs directory
+	certsDir := t.TempDir()
+	assert.NoError(os.Mkdir(filepath.Join(certsDir, secureHost), 0o755))
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw})
+	assert.NoError(os.WriteFile(filepath.Join(certsDir, secureHost, "ca.crt"), ca, 0o600))
+
+	client := newRegistryClient(RegistryOptions{Insecure: []string{plainHost}, CertsDir: certsDir})
+
+	dgst, err := client.manifestDigest(context.TODO(), plainHost+"/mycompany/web:1.0", "")
+	assert.NoError(err)
+	assert.Equal(newDigest, dgst.String())
+
+	dgst, err = client.manifestDigest(context.TODO(), secureHost+"/mycompany/web:1.0", "")
+	assert.NoError(err)
+	assert.Equal(newDigest, dgst.String())
+
+	// without the options the plain registry is queried over https and the test CA isn't trusted
+	client = newRegistryClient(RegistryOptions{})
+
+	_, err = client.manifestDigest(context.TODO(), plainHost+"/mycompany/web:1.0", "")
+	assert.Error(err)
+
+	_, err = client.manifestDigest(context.TODO(), secureHost+"/mycompany/web:1.0", "")
+	assert.Error(err)
+}
+
+func TestIdentityToken(t *testing.T) {
+	assert := test.New(t)
+
+	var ts *httptest.Server
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			// the identity token is exchanged with the refresh token grant
+			if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "refresh_token" ||
+				r.PostFormValue("refresh_token") != "identity-token" || r.PostFormValue("scope") != "repository:mycompany/web:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"secret-token"}`))
+		case r.Header.Get("Authorization") != "Bearer secret-token":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+ts.URL+`/token",service="test",scope="repository:mycompany/web:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("Docker-Content-Digest", newDigest)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	client := &registryClient{client: ts.Client()}
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	auth, err := registry.EncodeAuthConfig(registry.AuthConfig{IdentityToken: "identity-token"})
+	assert.NoError(err)
+
+	dgst, err := client.manifestDigest(context.TODO(), host+"/mycompany/web", auth)
+	assert.NoError(err)
+	assert.Equal(newDigest, dgst.String())
+
+	auth, err = registry.EncodeAuthConfig(registry.AuthConfig{IdentityToken: "expired"})
+	assert.NoError(err)
+
+	_, err = client.manifestDigest(context.TODO(), host+"/mycompany/web", auth)
+	assert.Error(err)
+}
@@ -0,0 +1,442 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultRemoteTimeout = 10 * time.Minute
+	jobPollInterval      = 2 * time.Second
+)
+
+var ErrRemote = errors.New("remote request failed")
+
+// remoteClient calls the http endpoint of a running updater.
+type remoteClient struct {
+	url    string
+	apiKey string
+	// sign the requests with the api key instead of sending it
+	sign   bool
+	client *http.Client
+}
+
+func newRemoteClient(baseURL, apiKey string) *remoteClient {
+	return &remoteClient{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		apiKey: apiKey,
+		client: &http.Client{Timeout: defaultRemoteTimeout},
+	}
+}
+
+// do sends the request with the body encoded as JSON, and decodes the response on out.
+func (r *remoteClient) do(ctx context.Context, method, path string, body, out any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if r.sign {
+		signRequest(req, r.apiKey, data, time.Now())
+	} else {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRemote, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		// the errors returned by echo have a message field
+		var httpErr struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&httpErr); err != nil || httpErr.Message == "" {
+			return fmt.Errorf("%w: %s", ErrRemote, resp.Status)
+		}
+
+		return fmt.Errorf("%w: %s: %s", ErrRemote, resp.Status, httpErr.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (r *remoteClient) Update(ctx context.Context, req UpdateRequest) (*UpdateResponse, error) {
+	response := &UpdateResponse{}
+	if err := r.do(ctx, http.MethodPost, "/apis/swarm/v1/update", req, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (r *remoteClient) Services(ctx context.Context) ([]ServiceInfo, error) {
+	var response struct {
+		Services []ServiceInfo `json:"services"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/apis/swarm/v1/services", nil, &response); err != nil {
+		return nil, err
+	}
+
+	return response.Services, nil
+}
+
+func (r *remoteClient) Explain(ctx context.Context, name string) (*Explanation, error) {
+	explanation := &Explanation{}
+	path := "/apis/swarm/v1/services/" + url.PathEscape(name) + "/explain"
+	if err := r.do(ctx, http.MethodGet, path, nil, explanation); err != nil {
+		return nil, err
+	}
+
+	return explanation, nil
+}
+
+func (r *remoteClient) Rollback(ctx context.Context, name string) (ServiceResult, error) {
+	var response struct {
+		Service ServiceResult `json:"service"`
+	}
+	path := "/apis/swarm/v1/services/" + url.PathEscape(name) + "/rollback"
+	if err := r.do(ctx, http.MethodPost, path, nil, &response); err != nil {
+		return ServiceResult{}, err
+	}
+
+	return response.Service, nil
+}
+
+func (r *remoteClient) History(ctx context.Context, service string, limit int) ([]HistoryEntry, error) {
+	query := url.Values{}
+	if service != "" {
+		query.Set("service", service)
+	}
+	query.Set("limit", strconv.Itoa(limit))
+
+	var response struct {
+		History []HistoryEntry `json:"history"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/apis/swarm/v1/history?"+query.Encode(), nil, &response); err != nil {
+		return nil, err
+	}
+
+	return response.History, nil
+}
+
+func (r *remoteClient) Jobs(ctx context.Context) ([]Job, error) {
+	var response struct {
+		Jobs []Job `json:"jobs"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/apis/swarm/v1/jobs", nil, &response); err != nil {
+		return nil, err
+	}
+
+	return response.Jobs, nil
+}
+
+func (r *remoteClient) Queue(ctx context.Context) (*QueueStatus, error) {
+	status := &QueueStatus{}
+	if err := r.do(ctx, http.MethodGet, "/apis/swarm/v1/queue", nil, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func (r *remoteClient) Job(ctx context.Context, id string) (*Job, error) {
+	job := &Job{}
+	if err := r.do(ctx, http.MethodGet, "/apis/swarm/v1/jobs/"+url.PathEscape(id), nil, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// WaitJob polls the job until it's finished.
+func (r *remoteClient) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	for {
+		job, err := r.Job(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if job.Status != JobRunning && job.Status != JobPending {
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func remoteFromContext(c *cli.Context) (*remoteClient, error) {
+	baseURL := c.GlobalString("url")
+	if baseURL == "" {
+		return nil, cli.NewExitError("missing the url of the updater", exitUsage)
+	}
+
+	remote := newRemoteClient(baseURL, c.GlobalString("apikey"))
+	remote.sign = c.GlobalBool("sign")
+
+	config, err := newClientTLSConfig(c.GlobalString("ca-cert"), c.GlobalString("client-cert"), c.GlobalString("client-key"))
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), exitUsage)
+	}
+
+	if config != nil {
+		remote.client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+
+	return remote, nil
+}
+
+func remoteUpdate(c *cli.Context) error {
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	// the update is always started as a job that is polled until it finishes, so a long rollout doesn't outlive the
+	// connection to the updater
+	req := UpdateRequest{
+		Images:        c.StringSlice("image"),
+		Services:      append(c.StringSlice("service"), c.Args()...),
+		Stacks:        c.StringSlice("stack"),
+		LabelSelector: c.String("label-selector"),
+		Force:         c.Bool("force"),
+		Async:         true,
+	}
+	async := c.Bool("async")
+
+	response, err := remote.Update(context.Background(), req)
+	if err != nil {
+		return err
+	}
+
+	if !async {
+		job, err := remote.WaitJob(context.Background(), response.Job, jobPollInterval)
+		if err != nil {
+			return err
+		}
+
+		if job.Status == JobFailed {
+			return fmt.Errorf("%w: job %s failed: %s", ErrRemote, job.ID, job.Error)
+		}
+
+		response = &UpdateResponse{Status: "ok", Job: job.ID}
+		if job.Result != nil {
+			response.Services = job.Result.Services
+			response.Matches = job.Result.Matches
+		}
+	}
+
+	err = writeOutput(c, response, func(w io.Writer) {
+		if async {
+			_, _ = fmt.Fprintf(w, "Started job %s\n", response.Job)
+			return
+		}
+		printResults(w, &RunResult{Services: response.Services})
+	})
+	if err != nil {
+		return err
+	}
+
+	return failedServices(response.Services)
+}
+
+func remoteList(c *cli.Context) error {
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	services, err := remote.Services(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, services, func(w io.Writer) { printServices(w, services) })
+}
+
+func remoteExplain(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return cli.NewExitError("missing service name", exitUsage)
+	}
+
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	explanation, err := remote.Explain(context.Background(), name)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, explanation, func(w io.Writer) { explanation.Print(w) })
+}
+
+func remoteRollback(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" {
+		return cli.NewExitError("missing service name", exitUsage)
+	}
+
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := remote.Rollback(context.Background(), name)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(c.App.Writer, "Rolled back %s to %s\n", result.Service, result.Image)
+
+	return nil
+}
+
+func remoteHistory(c *cli.Context) error {
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	entries, err := remote.History(context.Background(), c.String("service"), c.Int("limit"))
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, entries, func(w io.Writer) { printHistory(w, entries) })
+}
+
+func remoteJobs(c *cli.Context) error {
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	id := c.Args().First()
+	if id == "" {
+		jobs, err := remote.Jobs(context.Background())
+		if err != nil {
+			return err
+		}
+
+		return writeOutput(c, jobs, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "ID\tTRIGGER\tSTATUS\tCREATED\tSERVICES\tERROR")
+
+			for _, job := range jobs {
+				services := 0
+				if job.Result != nil {
+					services = len(job.Result.Services)
+				}
+				_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", job.ID, job.Trigger, job.Status,
+					job.Created.Format(time.RFC3339), services, job.Error)
+			}
+
+			_ = tw.Flush()
+		})
+	}
+
+	var job *Job
+	if c.Bool("wait") {
+		job, err = remote.WaitJob(context.Background(), id, jobPollInterval)
+	} else {
+		job, err = remote.Job(context.Background(), id)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writeOutput(c, job, func(w io.Writer) {
+		_, _ = fmt.Fprintf(w, "Job:     %s\n", job.ID)
+		_, _ = fmt.Fprintf(w, "Trigger: %s\n", job.Trigger)
+		_, _ = fmt.Fprintf(w, "Status:  %s\n", job.Status)
+		if job.Error != "" {
+			_, _ = fmt.Fprintf(w, "Error:   %s\n", job.Error)
+		}
+		if job.Result != nil {
+			printResults(w, job.Result)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if job.Status == JobFailed {
+		return cli.NewExitError("", exitError)
+	}
+
+	if job.Result != nil {
+		return failedServices(job.Result.Services)
+	}
+
+	return nil
+}
+
+func remoteQueue(c *cli.Context) error {
+	remote, err := remoteFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	status, err := remote.Queue(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, status, func(w io.Writer) {
+		_, _ = fmt.Fprintf(w, "Pending: %d\n", status.Pending)
+		_, _ = fmt.Fprintf(w, "Running: %d\n", status.Running)
+	})
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestRemoteClient(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "foo:1"}}}
+
+		return service
+	}
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{newService("web"), newService("db")}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return newService(serviceID), nil, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1, Blacklist: []*regexp.Regexp{regexp.MustCompile("^db$")}}
+	keys, err := newKeyStore("secret", "")
+	assert.NoError(err)
+
+	ts := httptest.NewServer(newServer(context.TODO(), s, &authenticator{keys: keys}).echo(false))
+	defer ts.Close()
+
+	remote := newRemoteClient(ts.URL+"/", "secret")
+
+	response, err := remote.Update(context.TODO(), UpdateRequest{Services: []string{"web"}})
+	assert.NoError(err)
+	assert.Equal("ok", response.Status)
+	assert.NotEmpty(response.Job)
+	assert.Len(response.Services, 1)
+	assert.Equal(StatusUpdated, response.Services[0].Status)
+
+	response, err = remote.Update(context.TODO(), UpdateRequest{Services: []string{"web"}, Async: true})
+	assert.NoError(err)
+	assert.Equal("accepted", response.Status)
+
+	job, err := remote.WaitJob(context.TODO(), response.Job, time.Millisecond)
+	assert.NoError(err)
+	assert.Equal(JobDone, job.Status)
+	assert.Equal(jobRequest, job.Trigger)
+	assert.Equal([]string{"web"}, job.Request.Services)
+	assert.Len(job.Result.Services, 1)
+
+	jobs, err := remote.Jobs(context.TODO())
+	assert.NoError(err)
+	assert.Len(jobs, 2)
+	assert.Equal(response.Job, jobs[0].ID)
+
+	status, err := remote.Queue(context.TODO())
+	assert.NoError(err)
+	assert.Equal(QueueStatus{}, *status)
+
+	_, err = remote.Job(context.TODO(), "unknown")
+	assert.ErrorIs(err, ErrRemote)
+	assert.ErrorContains(err, "404")
+
+	result, err := remote.Rollback(context.TODO(), "web")
+	assert.NoError(err)
+	assert.Equal("foo:1", result.Image)
+
+	_, err = remote.Rollback(context.TODO(), "db")
+	assert.ErrorContains(err, "403")
+
+	entries, err := remote.History(context.TODO(), "web", 2)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+	assert.Equal(actionRollback, entries[0].Action)
+	assert.Equal(actionUpdate, entries[1].Action)
+
+	services, err := remote.Services(context.TODO())
+	assert.NoError(err)
+	assert.Len(services, 2)
+
+	_, err = remote.Update(context.TODO(), UpdateRequest{})
+	assert.ErrorContains(err, "No services to update")
+
+	_, err = newRemoteClient(ts.URL, "wrong").Jobs(context.TODO())
+	assert.ErrorContains(err, "401")
+}
+
+func TestRemoteUpdateWriteTimeout(t *testing.T) {
+	assert := test.New(t)
+
+	service := swarm.Service{ID: "web"}
+	service.Spec.Name = "web"
+	service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest"}
+	service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "foo:1"}}}
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{service}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, _ string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return service, nil, nil
+	}
+	// the rollout takes longer than the write timeout of the server
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		time.Sleep(200 * time.Millisecond)
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1}
+	keys, err := newKeyStore("secret", "")
+	assert.NoError(err)
+
+	ts := httptest.NewUnstartedServer(newServer(context.TODO(), s, &authenticator{keys: keys}).echo(false))
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	response, err := newRemoteClient(ts.URL, "secret").Update(context.TODO(), UpdateRequest{Services: []string{"web"}})
+	assert.NoError(err)
+	assert.Equal("ok", response.Status)
+
+	// the command polls the job and prints the same response
+	output, code := runApp("remote", "--url", ts.URL, "--apikey", "secret", "update", "--output", "json", "web")
+	assert.Equal(0, code, output)
+	assert.Contains(output, `"status": "ok"`)
+	assert.Contains(output, `"status": "updated"`)
+}
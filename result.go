@@ -0,0 +1,80 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+const (
+	StatusUpdated  = "updated"
+	StatusUpToDate = "up-to-date"
+	StatusSkipped  = "skipped"
+	StatusFailed   = "failed"
+	// StatusOutdated is used on dry runs for the services that would be updated
+	StatusOutdated = "outdated"
+	// StatusRateLimited is used for the services deferred as the pull quota of their registry is low
+	StatusRateLimited = "rate-limited"
+	// StatusRegistryUnavailable is used for the services skipped as the circuit breaker of their registry is open
+	StatusRegistryUnavailable = "registry-unavailable"
+)
+
+// ServiceResult is the outcome of the update of a single service.
+type ServiceResult struct {
+	Service       string              `json:"service"`
+	Stack         string              `json:"stack,omitempty"`
+	Image         string              `json:"image,omitempty"`
+	PreviousImage string              `json:"previousImage,omitempty"`
+	Status        string              `json:"status"`
+	Reason        string              `json:"reason,omitempty"`
+	UpdateConfig  *swarm.UpdateConfig `json:"updateConfig,omitempty"`
+	Error         string              `json:"error,omitempty"`
+	ErrorClass    string              `json:"errorClass,omitempty"`
+}
+
+// serviceResult returns the result of the service, with its current image.
+func serviceResult(service swarm.Service) ServiceResult {
+	return ServiceResult{
+		Service: service.Spec.Name,
+		Stack:   service.Spec.Labels[stackNamespaceLabel],
+		Image:   service.Spec.TaskTemplate.ContainerSpec.Image,
+	}
+}
+
+// RunResult is the outcome of an update run.
+type RunResult struct {
+	Services []ServiceResult `json:"services"`
+	// Matches has the services matched by every requested image
+	Matches map[string][]string `json:"matches,omitempty"`
+	mu      sync.Mutex
+}
+
+func (r *RunResult) add(result ServiceResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Services = append(r.Services, result)
+}
+
+func (r *RunResult) addMatch(image, service string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Matches[image] = append(r.Matches[image], service)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const queueFile = "queue.json"
+
+// queuedUpdate is a pending or running update saved on the data directory, so it can be resumed after a restart.
+type queuedUpdate struct {
+	Job      string      `json:"job"`
+	Trigger  string      `json:"trigger"`
+	Identity string      `json:"identity"`
+	Callers  []string    `json:"callers,omitempty"`
+	Access   *AccessRule `json:"access,omitempty"`
+	// Selection has the services selected by the update and its options
+	Selection UpdateRequest `json:"selection"`
+	Created   time.Time     `json:"created"`
+	// Started is set if the update was running
+	Started *time.Time `json:"started,omitempty"`
+}
+
+func newQueuedUpdate(item *workItem) queuedUpdate {
+	update := queuedUpdate{
+		Job:      item.job.ID,
+		Trigger:  item.job.Trigger,
+		Identity: item.opts.Caller.Identity,
+		Callers:  item.job.Callers,
+		Access:   item.opts.Caller.Access,
+		Selection: UpdateRequest{
+			Images:        item.opts.Images,
+			Targets:       item.opts.Targets,
+			Services:      item.opts.Services,
+			Stacks:        item.opts.Stacks,
+			LabelSelector: item.opts.LabelSelector,
+			Force:         item.opts.Force,
+		},
+		Created: item.job.Created,
+	}
+
+	if !item.started.IsZero() {
+		update.Started = &item.started
+	}
+
+	return update
+}
+
+// save writes the running and pending updates to the queue file, the running ones first. It must be called with
+// the lock held.
+func (q *workQueue) save() {
+	if q.path == "" {
+		return
+	}
+
+	updates := make([]queuedUpdate, 0, len(q.running)+len(q.pending))
+	for _, item := range q.running {
+		updates = append(updates, newQueuedUpdate(item))
+	}
+	for _, item := range q.pending {
+		updates = append(updates, newQueuedUpdate(item))
+	}
+
+	if err := writeQueueFile(q.path, updates); err != nil {
+		slog.Error("Cannot save the update queue", "error", err.Error())
+	}
+}
+
+// writeQueueFile replaces the file atomically, so a crash never leaves it half written.
+func writeQueueFile(path string, updates []queuedUpdate) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("cannot create the data directory: %w", err)
+	}
+
+	data, err := json.Marshal(updates)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("cannot write the queue file: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// restore queues the updates saved on the queue file, with the ids of their jobs. The updates that were running
+// are retried from the time they started, so the services that they already changed aren't updated again.
+func (q *workQueue) restore() error {
+	if q.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(q.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("cannot read the queue file: %w", err)
+	}
+
+	var updates []queuedUpdate
+	if err := json.Unmarshal(data, &updates); err != nil {
+		return fmt.Errorf("cannot parse the queue file: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, update := range updates {
+		if update.Access != nil {
+			if err := update.Access.compile(); err != nil {
+				slog.Error("Dropping queued update with an invalid access rule", "job", update.Job, "error", err.Error())
+				continue
+			}
+		}
+
+		opts := update.Selection.options()
+		opts.Caller = Caller{Identity: update.Identity, Access: update.Access}
+
+		item := &workItem{
+			job:  q.jobs.resume(update.Job, update.Trigger, update.Identity, update.Created),
+			opts: opts,
+			key:  workKey(opts),
+			done: make(chan struct{}),
+		}
+
+		for _, identity := range update.Callers {
+			q.jobs.join(item.job, identity)
+		}
+
+		if update.Trigger == jobRequest {
+			item.req = &update.Selection
+		}
+
+		if update.Started != nil {
+			item.started = *update.Started
+			item.opts.ResumedFrom = *update.Started
+			slog.Info("Retrying interrupted update", "job", update.Job, "started", update.Started.Format(time.RFC3339))
+		} else {
+			slog.Info("Resuming queued update", "job", update.Job)
+		}
+
+		q.pending = append(q.pending, item)
+	}
+
+	q.notify()
+
+	return nil
+}
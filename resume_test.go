@@ -0,0 +1,165 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestQueuePersistence(t *testing.T) {
+	assert := test.New(t)
+
+	s := &Swarm{client: &dockerClientMock{}, MaxThreads: 1, DataDir: t.TempDir()}
+
+	// the dispatcher isn't started, so the updates stay pending
+	queue := newWorkQueue(s, &jobStore{})
+	access := &AccessRule{Stacks: []string{"shop"}, Images: []string{"mycompany/*"}}
+	assert.NoError(access.compile())
+
+	req := &UpdateRequest{Images: []string{"mycompany/web"}, Force: true}
+	opts := req.options()
+	opts.Caller = Caller{Identity: "ci", Access: access}
+
+	first := queue.submit(jobRequest, req, opts)
+	second := queue.submit(jobScheduled, nil, UpdateOptions{Caller: Caller{Identity: jobScheduled}})
+
+	jobs := &jobStore{}
+	restored := newWorkQueue(s, jobs)
+	assert.NoError(restored.restore())
+	assert.Equal(QueueStatus{Pending: 2}, restored.status())
+
+	job, ok := jobs.get(first.job.ID)
+	assert.True(ok)
+	assert.Equal(JobPending, job.Status)
+	assert.Equal("ci", job.Identity)
+
+	_, ok = jobs.get(second.job.ID)
+	assert.True(ok)
+
+	item := restored.pending[0]
+	assert.Equal(first.key, item.key)
+	assert.Equal([]string{"mycompany/web"}, item.req.Images)
+	assert.True(item.opts.Force)
+	assert.True(item.opts.ResumedFrom.IsZero())
+	assert.True(item.opts.Caller.Access.allows("shop_web", "shop", "mycompany/web:latest"))
+	assert.False(item.opts.Caller.Access.allows("blog_web", "blog", "mycompany/web:latest"))
+	assert.Nil(restored.pending[1].req)
+
+	// a missing file is an empty queue
+	assert.NoError(os.Remove(filepath.Join(s.DataDir, queueFile)))
+	assert.NoError(newWorkQueue(s, &jobStore{}).restore())
+
+	assert.NoError(os.WriteFile(filepath.Join(s.DataDir, queueFile), []byte("{"), 0o600))
+	assert.Error(newWorkQueue(s, &jobStore{}).restore())
+}
+
+func TestResumeInterruptedUpdate(t *testing.T) {
+	assert := test.New(t)
+
+	started := time.Now().Add(-time.Minute)
+
+	newService := func(name string, updated time.Time) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.UpdatedAt = updated
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "mycompany/" + name + ":latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	services := func() []swarm.Service {
+		// web was redeployed by the interrupted update, api wasn't reached
+		return []swarm.Service{newService("web", started.Add(time.Second)), newService("api", started.Add(-time.Hour))}
+	}
+
+	var updated []string
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return services(), nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		for _, service := range services() {
+			if service.ID == serviceID {
+				return service, nil, nil
+			}
+		}
+
+		return swarm.Service{}, nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updated = append(updated, serviceID)
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1, DataDir: t.TempDir()}
+	path := filepath.Join(s.DataDir, queueFile)
+
+	assert.NoError(writeQueueFile(path, []queuedUpdate{{
+		Job:       "0123456789abcdef",
+		Trigger:   jobRequest,
+		Identity:  "ci",
+		Selection: UpdateRequest{Services: []string{"web", "api"}, Force: true},
+		Created:   started,
+		Started:   &started,
+	}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	keys, err := newKeyStore("secret", "")
+	assert.NoError(err)
+
+	srv := newServer(ctx, s, &authenticator{keys: keys})
+
+	assert.Eventually(func() bool {
+		job, ok := srv.jobs.get("0123456789abcdef")
+		return ok && job.Status == JobDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal([]string{"api"}, updated)
+
+	job, _ := srv.jobs.get("0123456789abcdef")
+	for _, result := range job.Result.Services {
+		if result.Service == "web" {
+			assert.Equal(StatusSkipped, result.Status)
+			assert.Equal("changed since the interrupted update started", result.Reason)
+		} else {
+			assert.Equal(StatusUpdated, result.Status)
+		}
+	}
+
+	// the finished update is removed from the file
+	data, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.JSONEq("[]", string(data))
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	ErrorConflict         = "conflict"
+	ErrorNetwork          = "network"
+	ErrorServer           = "server"
+	ErrorAuth             = "auth"
+	ErrorNotFound         = "not-found"
+	ErrorInvalidReference = "invalid-reference"
+	ErrorCanceled         = "canceled"
+	ErrorUnknown          = "unknown"
+)
+
+const defaultRetryAttempts = 3
+
+// classifyError returns the class of a docker or registry error. The daemon returns most registry errors as
+// internal errors, so their messages are also checked.
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	message := strings.ToLower(err.Error())
+	contains := func(values ...string) bool {
+		for _, value := range values {
+			if strings.Contains(message, value) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errdefs.IsConflict(err) || contains("update out of sequence"):
+		return ErrorConflict
+	case errors.Is(err, reference.ErrReferenceInvalidFormat) || errors.Is(err, reference.ErrNameContainsUppercase) ||
+		errors.Is(err, reference.ErrTagInvalidFormat) || errors.Is(err, reference.ErrNameTooLong) ||
+		errors.Is(err, digest.ErrDigestInvalidFormat) || contains("invalid reference format"):
+		return ErrorInvalidReference
+	case errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) ||
+		contains("unauthorized", "authentication required", "access to the resource is denied", "denied:"):
+		return ErrorAuth
+	case errdefs.IsNotFound(err) || contains("manifest unknown", "not found", "no such"):
+		return ErrorNotFound
+	case errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, context.DeadlineExceeded) || errdefs.IsDeadline(err) ||
+		contains("connection refused", "connection reset", "i/o timeout", "tls handshake timeout", "no route to host"):
+		return ErrorNetwork
+	case errdefs.IsSystem(err) || errdefs.IsUnavailable(err) ||
+		contains("internal server error", "bad gateway", "service unavailable", "gateway timeout"):
+		return ErrorServer
+	default:
+		return ErrorUnknown
+	}
+}
+
+// retryable reports if the errors of the class can succeed if the update is tried again.
+func retryable(class string) bool {
+	return class == ErrorConflict || class == ErrorNetwork || class == ErrorServer
+}
+
+// appliedError is an error that happened after the service update was sent, the update isn't retried as it may
+// have been applied.
+type appliedError struct {
+	err error
+}
+
+func (e *appliedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *appliedError) Unwrap() error {
+	return e.err
+}
+
+// RetryPolicy is how the updates that failed with a conflict, network or server error are retried.
+type RetryPolicy struct {
+	// Attempts is the max number of times that an update is tried, 3 if zero
+	Attempts int
+	// Delay is the wait before the first retry, it's doubled on every retry up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// backoff returns the wait before the retry, starting from zero. Half of it is random, so the updates that failed
+// together don't retry at the same time.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.Delay <= 0 {
+		return 0
+	}
+
+	delay := p.Delay
+	for range retry {
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts <= 0 {
+		return defaultRetryAttempts
+	}
+
+	return p.Attempts
+}
+
+// ErrorStats are the failed service updates by error class, and the number of retried attempts.
+type ErrorStats struct {
+	Failures map[string]int64 `json:"failures"`
+	Retries  int64            `json:"retries"`
+}
+
+type errorCounters struct {
+	mu       sync.Mutex
+	failures map[string]int64
+	retries  int64
+}
+
+func (e *errorCounters) failed(class string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.failures == nil {
+		e.failures = map[string]int64{}
+	}
+	e.failures[class]++
+}
+
+func (e *errorCounters) retried() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.retries++
+}
+
+// ErrorStats returns the failed service updates by error class, and the retried attempts.
+func (c *Swarm) ErrorStats() ErrorStats {
+	c.errors.mu.Lock()
+	defer c.errors.mu.Unlock()
+
+	failures := make(map[string]int64, len(c.errors.failures))
+	for class, count := range c.errors.failures {
+		failures[class] = count
+	}
+
+	return ErrorStats{Failures: failures, Retries: c.errors.retries}
+}
+
+// fail marks the result as failed with the error and its class.
+func (c *Swarm) fail(result *ServiceResult, err error) {
+	result.Status = StatusFailed
+	result.Error = err.Error()
+	result.ErrorClass = classifyError(err)
+	c.errors.failed(result.ErrorClass)
+}
+
+// updateServiceWithRetries updates the service, retrying the errors that can be retried with the retry policy. The
+// service version is refreshed after a conflict.
+func (c *Swarm) updateServiceWithRetries(ctx context.Context, service swarm.Service, target imageTarget) (ServiceResult, error) {
+	for attempt := 1; ; attempt++ {
+		// the update changes the image of the container spec, every attempt starts from the original one
+		attemptService := service
+		containerSpec := *service.Spec.TaskTemplate.ContainerSpec
+		attemptService.Spec.TaskTemplate.ContainerSpec = &containerSpec
+
+		result, err := c.updateService(ctx, attemptService, target)
+		if err == nil {
+			return result, nil
+		}
+
+		class := classifyError(err)
+
+		var applied *appliedError
+		if errors.As(err, &applied) || !retryable(class) || attempt >= c.Retry.attempts() {
+			return result, err
+		}
+
+		delay := c.Retry.backoff(attempt - 1)
+		slog.Debug("Retrying service update", "service", service.Spec.Name, "class", class, "attempt", attempt,
+			"delay", delay, "error", err)
+		c.errors.retried()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, err
+		}
+
+		if class == ErrorConflict {
+			// fetch a newer service version
+			updatedService, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+			if err != nil {
+				return result, fmt.Errorf("ServiceInspect failed: %w", err)
+			}
+
+			service.Version = updatedService.Version
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	assert := test.New(t)
+
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{errors.New("rpc error: code = Unknown desc = update out of sequence"), ErrorConflict},
+		{errdefs.Conflict(errors.New("conflict")), ErrorConflict},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorNetwork},
+		{fmt.Errorf("failed to inspect image: %w", context.DeadlineExceeded), ErrorNetwork},
+		{errdefs.System(errors.New("received unexpected HTTP status: 503 Service Unavailable")), ErrorServer},
+		{errdefs.System(errors.New("errors: denied: requested access to the resource is denied")), ErrorAuth},
+		{errdefs.Unauthorized(errors.New("no credentials")), ErrorAuth},
+		{errdefs.NotFound(errors.New("no such service")), ErrorNotFound},
+		{errors.New("manifest unknown: manifest unknown"), ErrorNotFound},
+		{fmt.Errorf("failed to parse image name: %w", reference.ErrReferenceInvalidFormat), ErrorInvalidReference},
+		{fmt.Errorf("update: %w", context.Canceled), ErrorCanceled},
+		{errors.New("something else"), ErrorUnknown},
+	}
+
+	for _, c := range cases {
+		assert.Equal(c.class, classifyError(c.err), c.err.Error())
+	}
+
+	assert.Empty(classifyError(nil))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert := test.New(t)
+
+	policy := RetryPolicy{Delay: time.Second, MaxDelay: 5 * time.Second}
+
+	for retry, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		backoff := policy.backoff(retry)
+		assert.GreaterOrEqual(backoff, delay/2)
+		assert.LessOrEqual(backoff, delay)
+	}
+
+	assert.Zero(RetryPolicy{}.backoff(3))
+	assert.Equal(defaultRetryAttempts, RetryPolicy{}.attempts())
+}
+
+func TestUpdateRetries(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "mycompany/" + name + ":latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	failures := map[string][]error{}
+	var versions []uint64
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{newService("web"), newService("api"), newService("worker")}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		service := newService(serviceID)
+		service.Version.Index = 2
+
+		return service, nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, version swarm.Version, _ swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		if serviceID == "web" {
+			versions = append(versions, version.Index)
+		}
+
+		if len(failures[serviceID]) > 0 {
+			err := failures[serviceID][0]
+			failures[serviceID] = failures[serviceID][1:]
+
+			return swarm.ServiceUpdateResponse{}, err
+		}
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := &Swarm{client: &mock, MaxThreads: 1, Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond}}
+
+	// web gets a conflict and succeeds with the latest version, api runs out of attempts and worker can't be retried
+	failures["web"] = []error{errors.New("rpc error: code = Unknown desc = update out of sequence")}
+	failures["api"] = []error{errors.New("i/o timeout"), errors.New("i/o timeout"), errors.New("i/o timeout")}
+	failures["worker"] = []error{errors.New("unauthorized: authentication required"), nil}
+
+	run, err := s.Update(context.TODO(), UpdateOptions{})
+	assert.NoError(err)
+
+	results := map[string]ServiceResult{}
+	for _, result := range run.Services {
+		results[result.Service] = result
+	}
+
+	assert.Equal(StatusUpdated, results["web"].Status)
+	assert.Equal([]uint64{0, 2}, versions)
+
+	assert.Equal(StatusFailed, results["api"].Status)
+	assert.Equal(ErrorNetwork, results["api"].ErrorClass)
+	assert.Empty(failures["api"])
+
+	assert.Equal(StatusFailed, results["worker"].Status)
+	assert.Equal(ErrorAuth, results["worker"].ErrorClass)
+	assert.Len(failures["worker"], 1)
+
+	assert.Equal(ErrorStats{Failures: map[string]int64{ErrorNetwork: 1, ErrorAuth: 1}, Retries: 3}, s.ErrorStats())
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/docker/docker/api/types"
+)
+
+var (
+	ErrNotManaged     = errors.New("service is not managed by the updater")
+	ErrNoPreviousSpec = errors.New("service has no previous spec to rollback")
+	ErrNotAllowed     = errors.New("caller is not allowed to act on the service")
+)
+
+// Rollback reverts a service managed by the updater to its previous spec, if the caller is allowed to.
+func (c *Swarm) Rollback(ctx context.Context, name string, caller Caller) (ServiceResult, error) {
+	service, _, err := c.client.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if err != nil {
+		return ServiceResult{Service: name}, fmt.Errorf("cannot inspect service %s: %w", name, err)
+	}
+
+	waited, err := c.locks.lock(ctx, service.ID)
+	if err != nil {
+		return ServiceResult{Service: name}, err
+	}
+	defer c.locks.unlock(service.ID)
+
+	if waited {
+		// the service may have been updated while waiting
+		service, _, err = c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			return ServiceResult{Service: name}, fmt.Errorf("cannot inspect service %s: %w", name, err)
+		}
+	}
+
+	result := serviceResult(service)
+	result.PreviousImage, result.Image = result.Image, ""
+
+	if managed, reason := c.serviceDecision(service); !managed {
+		return result, fmt.Errorf("%w: %s", ErrNotManaged, reason)
+	}
+
+	if !caller.Access.allowsService(service) {
+		return result, fmt.Errorf("%w: %s", ErrNotAllowed, caller.Identity)
+	}
+
+	if service.PreviousSpec == nil || service.PreviousSpec.TaskTemplate.ContainerSpec == nil {
+		return result, ErrNoPreviousSpec
+	}
+
+	result.Image = service.PreviousSpec.TaskTemplate.ContainerSpec.Image
+
+	encodedAuth, err := c.registryAuth(ctx, result.Image, service.Spec.Labels[credentialLabel])
+	if err != nil {
+		return result, err
+	}
+
+	slog.Info("Rolling back service", "service", service.Spec.Name, "image", result.Image, "identity", caller.Identity)
+
+	_, err = c.client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{
+		EncodedRegistryAuth: encodedAuth,
+		Rollback:            "previous",
+	})
+	if err != nil {
+		result.Status = StatusFailed
+		result.Error = err.Error()
+		c.recordHistory(actionRollback, caller.Identity, result)
+
+		return result, fmt.Errorf("failed to rollback service %s: %w", service.Spec.Name, err)
+	}
+
+	result.Status = StatusUpdated
+	c.recordHistory(actionRollback, caller.Identity, result)
+
+	return result, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestRollback(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		service := swarm.Service{ID: serviceID}
+		service.Spec.Name = serviceID
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:2"}
+		if serviceID != "new" {
+			service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "foo:1"}}}
+		}
+
+		return service, nil, nil
+	}
+
+	var rollbacks []string
+	mock.ServiceUpdateFn = func(_ context.Context, serviceID string, _ swarm.Version, _ swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		assert.Equal("previous", options.Rollback)
+		rollbacks = append(rollbacks, serviceID)
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := Swarm{client: &mock, Blacklist: []*regexp.Regexp{regexp.MustCompile("^db$")}}
+
+	result, err := s.Rollback(context.TODO(), "web", Caller{Identity: "test"})
+	assert.NoError(err)
+	assert.Equal(StatusUpdated, result.Status)
+	assert.Equal("foo:1", result.Image)
+	assert.Equal("foo:2", result.PreviousImage)
+
+	_, err = s.Rollback(context.TODO(), "db", Caller{Identity: "test"})
+	assert.ErrorIs(err, ErrNotManaged)
+
+	_, err = s.Rollback(context.TODO(), "new", Caller{Identity: "test"})
+	assert.ErrorIs(err, ErrNoPreviousSpec)
+
+	_, err = s.Rollback(context.TODO(), "web", Caller{Identity: "test", Access: &AccessRule{Services: []string{"api"}}})
+	assert.ErrorIs(err, ErrNotAllowed)
+
+	assert.Equal([]string{"web"}, rollbacks)
+
+	entries, err := s.History("", 0)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal(actionRollback, entries[0].Action)
+	assert.Equal("test", entries[0].Identity)
+}
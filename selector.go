@@ -0,0 +1,107 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+// ErrInvalidSelector is returned when a label selector can't be parsed.
+var ErrInvalidSelector = errors.New("invalid label selector")
+
+// labelRequirement is a single condition of a label selector.
+type labelRequirement struct {
+	key      string
+	value    string
+	negate   bool
+	hasValue bool
+}
+
+// serviceSelector selects services by name, stack or labels. Empty fields match every service.
+type serviceSelector struct {
+	services []string
+	stacks   []string
+	labels   []labelRequirement
+}
+
+// parseLabelSelector parses a comma separated list of `key`, `key=value` and `key!=value` requirements.
+func parseLabelSelector(selector string) ([]labelRequirement, error) {
+	var requirements []labelRequirement
+
+	for _, entry := range strings.Split(selector, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		requirement := labelRequirement{key: entry}
+		if key, value, ok := strings.Cut(entry, "!="); ok {
+			requirement = labelRequirement{key: key, value: value, negate: true, hasValue: true}
+		} else if key, value, ok := strings.Cut(entry, "="); ok {
+			requirement = labelRequirement{key: key, value: value, hasValue: true}
+		}
+
+		requirement.key = strings.TrimSpace(requirement.key)
+		requirement.value = strings.TrimSpace(requirement.value)
+		if requirement.key == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSelector, entry)
+		}
+
+		requirements = append(requirements, requirement)
+	}
+
+	return requirements, nil
+}
+
+func (r labelRequirement) match(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	if !r.hasValue {
+		return ok
+	}
+
+	return (ok && value == r.value) != r.negate
+}
+
+func (s serviceSelector) empty() bool {
+	return len(s.services) == 0 && len(s.stacks) == 0 && len(s.labels) == 0
+}
+
+// match reports if the service is selected by name, stack and every label requirement.
+func (s serviceSelector) match(service swarm.Service) bool {
+	if len(s.services) > 0 && !slices.Contains(s.services, service.Spec.Name) && !slices.Contains(s.services, service.ID) {
+		return false
+	}
+
+	if len(s.stacks) > 0 && !slices.Contains(s.stacks, service.Spec.Labels[stackNamespaceLabel]) {
+		return false
+	}
+
+	for _, requirement := range s.labels {
+		if !requirement.match(service.Spec.Labels) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	assert := test.New(t)
+
+	requirements, err := parseLabelSelector("tier=web, canary, env!=prod")
+	assert.NoError(err)
+	assert.Equal([]labelRequirement{
+		{key: "tier", value: "web", hasValue: true},
+		{key: "canary"},
+		{key: "env", value: "prod", negate: true, hasValue: true},
+	}, requirements)
+
+	_, err = parseLabelSelector("=web")
+	assert.ErrorIs(err, ErrInvalidSelector)
+}
+
+func TestServiceSelector(t *testing.T) {
+	assert := test.New(t)
+
+	service := swarm.Service{ID: "abc"}
+	service.Spec.Name = "shop_web"
+	service.Spec.Labels = map[string]string{stackNamespaceLabel: "shop", "tier": "web"}
+
+	assert.True(serviceSelector{}.match(service))
+	assert.True(serviceSelector{services: []string{"shop_web"}}.match(service))
+	assert.True(serviceSelector{services: []string{"abc"}}.match(service))
+	assert.False(serviceSelector{services: []string{"shop_db"}}.match(service))
+	assert.True(serviceSelector{stacks: []string{"other", "shop"}}.match(service))
+	assert.False(serviceSelector{stacks: []string{"other"}}.match(service))
+
+	labels, _ := parseLabelSelector("tier=web,env!=prod")
+	assert.True(serviceSelector{stacks: []string{"shop"}, labels: labels}.match(service))
+
+	labels, _ = parseLabelSelector("tier=db")
+	assert.False(serviceSelector{labels: labels}.match(service))
+}
+
+func TestUpdateForce(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name, stack string) swarm.Service {
+		service := swarm.Service{ID: stack + "_" + name}
+		service.Spec.Name = stack + "_" + name
+		service.Spec.Labels = map[string]string{stackNamespaceLabel: stack}
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest@" + newDigest}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	services := []swarm.Service{newService("web", "shop"), newService("db", "shop"), newService("web", "blog")}
+	var forced []string
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return services, nil
+	}
+	// the digest of the image didn't change
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		for _, service := range services {
+			if service.ID == serviceID {
+				return service, nil, nil
+			}
+		}
+
+		return swarm.Service{}, nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, spec swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		assert.Equal(uint64(1), spec.TaskTemplate.ForceUpdate)
+		forced = append(forced, spec.Name)
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1, Blacklist: []*regexp.Regexp{regexp.MustCompile("_db$")}}
+	result, err := s.Update(context.TODO(), UpdateOptions{Stacks: []string{"shop"}, Force: true})
+	assert.NoError(err)
+	assert.Equal([]string{"shop_web"}, forced)
+	assert.Len(result.Services, 1)
+	assert.Equal(StatusUpdated, result.Services[0].Status)
+
+	forced = nil
+	result, err = s.Update(context.TODO(), UpdateOptions{Stacks: []string{"shop"}})
+	assert.NoError(err)
+	assert.Empty(forced)
+	assert.Equal(StatusUpToDate, result.Services[0].Status)
+}
+
+func TestUpdateSelectedSelf(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func(name string, labels map[string]string) swarm.Service {
+		service := swarm.Service{ID: name}
+		service.Spec.Name = name
+		service.Spec.Labels = labels
+		service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "foo:latest"}
+		service.PreviousSpec = &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+
+		return service
+	}
+
+	services := []swarm.Service{newService("web", nil), newService("updater", map[string]string{serviceLabel: "true"})}
+	var updated []string
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return services, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, serviceID string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return newService(serviceID, nil), nil, nil
+	}
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, spec swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updated = append(updated, spec.Name)
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1}
+
+	// the updater isn't redeployed by a run that selects other services
+	_, err := s.Update(context.TODO(), UpdateOptions{Services: []string{"web"}})
+	assert.NoError(err)
+	assert.Equal([]string{"web"}, updated)
+
+	updated = nil
+	_, err = s.Update(context.TODO(), UpdateOptions{Services: []string{"updater"}})
+	assert.NoError(err)
+	assert.Equal([]string{"updater"}, updated)
+
+	// but it's updated last by the full runs
+	updated = nil
+	_, err = s.Update(context.TODO(), UpdateOptions{})
+	assert.NoError(err)
+	assert.Equal([]string{"web", "updater"}, updated)
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// UpdateRequest selects the services that should be updated by image, name, stack or labels
+type UpdateRequest struct {
+	Images        []string       `json:"images"`
+	Targets       []UpdateTarget `json:"targets"`
+	Services      []string       `json:"services"`
+	Stacks        []string       `json:"stacks"`
+	LabelSelector string         `json:"labelSelector"`
+	Force         bool           `json:"force"`
+	// Async returns the job as soon as the update is started, instead of waiting for the result
+	Async bool `json:"async,omitempty"`
+}
+
+// UpdateResponse is the job of the update request and, unless it's async, the result of the update.
+type UpdateResponse struct {
+	Status   string              `json:"status"`
+	Job      string              `json:"job"`
+	Services []ServiceResult     `json:"services"`
+	Matches  map[string][]string `json:"matches,omitempty"`
+}
+
+func (r *UpdateRequest) options() UpdateOptions {
+	return UpdateOptions{
+		Images:        r.Images,
+		Targets:       r.Targets,
+		Services:      r.Services,
+		Stacks:        r.Stacks,
+		LabelSelector: r.LabelSelector,
+		Force:         r.Force,
+	}
+}
+
+// server exposes the swarm operations over http and keeps track of the update jobs.
+type server struct {
+	swarm *Swarm
+	auth  *authenticator
+	jobs  jobStore
+	queue *workQueue
+	// updatesPerMinute limits the update requests of each caller, zero disables the limit
+	updatesPerMinute int
+}
+
+// newServer returns the server and starts the dispatcher of its queue, which runs until the context is done. The
+// updates queued before a restart are resumed.
+func newServer(ctx context.Context, swarm *Swarm, auth *authenticator) *server {
+	s := &server{swarm: swarm, auth: auth}
+	s.queue = newWorkQueue(swarm, &s.jobs)
+
+	if err := s.queue.restore(); err != nil {
+		slog.Error("Cannot resume the queued updates", "error", err.Error())
+	}
+
+	go s.queue.run(ctx)
+
+	return s
+}
+
+// scheduled queues an update of every service, used by the cron schedule. It's skipped if there is one already
+// waiting on the queue.
+func (s *server) scheduled() {
+	item := s.queue.submit(jobScheduled, nil, UpdateOptions{Caller: Caller{Identity: jobScheduled}})
+	slog.Debug("Queued scheduled update", "job", item.job.ID)
+}
+
+// limitUpdates returns a middleware that limits the update requests per minute of each caller, if enabled.
+func (s *server) limitUpdates() echo.MiddlewareFunc {
+	if s.updatesPerMinute <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+
+	retryAfter := strconv.Itoa(int(math.Ceil(60 / float64(s.updatesPerMinute))))
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return callerFrom(c).Identity, nil
+		},
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:  rate.Limit(float64(s.updatesPerMinute) / 60),
+			Burst: s.updatesPerMinute,
+		}),
+		DenyHandler: func(c echo.Context, identity string, _ error) error {
+			slog.Warn("Rejected update request over the rate limit", "identity", identity)
+			c.Response().Header().Set("Retry-After", retryAfter)
+
+			return echo.NewHTTPError(http.StatusTooManyRequests,
+				fmt.Sprintf("%s exceeded the limit of %d update requests per minute", identity, s.updatesPerMinute))
+		},
+	})
+}
+
+// protect returns the middlewares of a route, which check that the request is signed if the route requires it, and
+// that the caller has the scope.
+func (s *server) protect(route, scope string) []echo.MiddlewareFunc {
+	return []echo.MiddlewareFunc{s.auth.requireSignature(route), requireScope(scope)}
+}
+
+func (s *server) echo(debug bool) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.Debug = debug
+	e.Use(middleware.Recover())
+	e.Use(s.auth.middleware())
+
+	e.POST("/apis/swarm/v1/update", s.update, append(s.protect(routeUpdate, ScopeUpdate), s.limitUpdates())...)
+	e.GET("/apis/swarm/v1/services", s.services, s.protect(routeServices, ScopeRead)...)
+	e.GET("/apis/swarm/v1/services/:name/explain", s.explain, s.protect(routeExplain, ScopeRead)...)
+	e.POST("/apis/swarm/v1/services/:name/rollback", s.rollback, s.protect(routeRollback, ScopeRollback)...)
+	e.GET("/apis/swarm/v1/history", s.history, s.protect(routeHistory, ScopeRead)...)
+	e.GET("/apis/swarm/v1/jobs", s.listJobs, s.protect(routeJobs, ScopeRead)...)
+	e.GET("/apis/swarm/v1/jobs/:id", s.getJob, s.protect(routeJobs, ScopeRead)...)
+	e.GET("/apis/swarm/v1/queue", s.queueStatus, s.protect(routeQueue, ScopeRead)...)
+	e.GET("/apis/swarm/v1/cache", s.cacheStats, s.protect(routeCache, ScopeRead)...)
+	e.GET("/apis/swarm/v1/errors", s.errorStats, s.protect(routeErrors, ScopeRead)...)
+
+	return e
+}
+
+func (s *server) update(c echo.Context) error {
+	req := &UpdateRequest{}
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Bind:"+err.Error())
+	}
+
+	if len(req.Images) == 0 && len(req.Targets) == 0 && len(req.Services) == 0 &&
+		len(req.Stacks) == 0 && req.LabelSelector == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "No services to update")
+	}
+
+	// validate the request before starting a job
+	if _, err := parseImagePatterns(req.Images, req.Targets); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if _, err := parseLabelSelector(req.LabelSelector); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	caller := callerFrom(c)
+	opts := req.options()
+	opts.Caller = caller
+
+	slog.Info("Received update request",
+		"identity", caller.Identity,
+		"images", strings.Join(req.Images, ","),
+		"targets", len(req.Targets),
+		"services", strings.Join(req.Services, ","),
+		"stacks", strings.Join(req.Stacks, ","),
+		"labelSelector", req.LabelSelector,
+		"force", req.Force,
+		"async", req.Async)
+
+	item := s.queue.submit(jobRequest, req, opts)
+
+	if req.Async {
+		return c.JSON(http.StatusAccepted, UpdateResponse{Status: "accepted", Job: item.job.ID})
+	}
+
+	// the response is sent when the rollout finishes, which can be after the write timeout of the server
+	if err := http.NewResponseController(c.Response()).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Debug("Cannot remove the write deadline of the update request", "error", err)
+	}
+
+	if err := item.wait(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusGatewayTimeout, "the request was cancelled, the job "+item.job.ID+" keeps running")
+	}
+
+	if item.err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Swarm update:"+item.err.Error())
+	}
+
+	return c.JSON(http.StatusOK, UpdateResponse{
+		Status:   "ok",
+		Job:      item.job.ID,
+		Services: item.result.Services,
+		Matches:  item.result.Matches,
+	})
+}
+
+func (s *server) services(c echo.Context) error {
+	services, err := s.swarm.Services(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Swarm services:"+err.Error())
+	}
+
+	// only list the services that the caller can act on
+	caller := callerFrom(c)
+	services = slices.DeleteFunc(services, func(info ServiceInfo) bool {
+		return !caller.Access.allows(info.Name, info.Stack, info.Image)
+	})
+
+	return c.JSON(http.StatusOK, map[string]any{"services": services})
+}
+
+func (s *server) explain(c echo.Context) error {
+	explanation, err := s.swarm.Explain(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Swarm explain:"+err.Error())
+	}
+
+	caller := callerFrom(c)
+	if !caller.Access.allows(explanation.Service, explanation.Stack, explanation.Image) {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("%s: %s", ErrNotAllowed, caller.Identity))
+	}
+
+	return c.JSON(http.StatusOK, explanation)
+}
+
+func (s *server) rollback(c echo.Context) error {
+	caller := callerFrom(c)
+	slog.Info("Received rollback request", "service", c.Param("name"), "identity", caller.Identity)
+
+	result, err := s.swarm.Rollback(c.Request().Context(), c.Param("name"), caller)
+	if err != nil {
+		switch {
+		case errdefs.IsNotFound(err):
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		case errors.Is(err, ErrNotManaged), errors.Is(err, ErrNotAllowed):
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		case errors.Is(err, ErrNoPreviousSpec):
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Swarm rollback:"+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"status": "ok", "service": result})
+}
+
+func (s *server) history(c echo.Context) error {
+	limit := 0
+	if value := c.QueryParam("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+	}
+
+	entries, err := s.swarm.allowedHistory(c.QueryParam("service"), limit, callerFrom(c).Access)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Swarm history:"+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"history": entries})
+}
+
+// visibleJob returns the job as the caller can see it. The callers limited to some services only get the results of
+// those services, and the requests of the other callers are hidden. The jobs of other callers without results of
+// their services aren't visible.
+func visibleJob(caller Caller, job Job) (Job, bool) {
+	if !caller.Access.restricted() {
+		return job, true
+	}
+
+	own := job.Identity == caller.Identity || slices.Contains(job.Callers, caller.Identity)
+
+	if job.Result != nil {
+		result := &RunResult{Services: []ServiceResult{}}
+		for _, service := range job.Result.Services {
+			if caller.Access.allows(service.Service, service.Stack, service.Image) {
+				result.Services = append(result.Services, service)
+			}
+		}
+
+		if own {
+			result.Matches = job.Result.Matches
+		}
+		job.Result = result
+	}
+
+	if !own {
+		if job.Result == nil || len(job.Result.Services) == 0 {
+			return Job{}, false
+		}
+		job.Request = nil
+	}
+
+	return job, true
+}
+
+func (s *server) listJobs(c echo.Context) error {
+	caller := callerFrom(c)
+
+	jobs := []Job{}
+	for _, job := range s.jobs.list() {
+		if job, ok := visibleJob(caller, job); ok {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"jobs": jobs})
+}
+
+func (s *server) getJob(c echo.Context) error {
+	job, ok := s.jobs.get(c.Param("id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "job not found")
+	}
+
+	caller := callerFrom(c)
+	job, ok = visibleJob(caller, job)
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("%s: %s", ErrNotAllowed, caller.Identity))
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+func (s *server) queueStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.queue.status())
+}
+
+func (s *server) cacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.swarm.CacheStats())
+}
+
+func (s *server) errorStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.swarm.ErrorStats())
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestUpdateRateLimit(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return nil, nil
+	}
+
+	keys, err := newKeyStore("", "")
+	assert.NoError(err)
+	assert.NoError(keys.add(&APIKey{Name: "ci", Key: "ci-secret", Scopes: []string{ScopeUpdate}}))
+	assert.NoError(keys.add(&APIKey{Name: "ops", Key: "ops-secret", Scopes: []string{ScopeUpdate}}))
+
+	srv := newServer(context.TODO(), &Swarm{client: &mock, MaxThreads: 1}, &authenticator{keys: keys})
+	srv.updatesPerMinute = 2
+	ts := httptest.NewServer(srv.echo(false))
+	defer ts.Close()
+
+	ci := newRemoteClient(ts.URL, "ci-secret")
+	for range 2 {
+		_, err := ci.Update(context.TODO(), UpdateRequest{Images: []string{"nginx"}})
+		assert.NoError(err)
+	}
+
+	_, err = ci.Update(context.TODO(), UpdateRequest{Images: []string{"nginx"}})
+	assert.ErrorContains(err, "429")
+	assert.ErrorContains(err, "ci exceeded the limit of 2 update requests per minute")
+
+	// the limit is per caller
+	_, err = newRemoteClient(ts.URL, "ops-secret").Update(context.TODO(), UpdateRequest{Images: []string{"nginx"}})
+	assert.NoError(err)
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/apis/swarm/v1/update", nil)
+	assert.NoError(err)
+	req.Header.Set("Authorization", "Bearer ci-secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("30", resp.Header.Get("Retry-After"))
+}
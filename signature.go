@@ -0,0 +1,197 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signaturePrefix          = "sha256="
+	// max difference between the signature timestamp and the updater clock
+	signatureTolerance = 5 * time.Minute
+	// max size of a signed request body
+	maxSignedBody = 1 << 20
+)
+
+// names of the routes that can require a signature
+const (
+	routeUpdate   = "update"
+	routeServices = "services"
+	routeExplain  = "explain"
+	routeRollback = "rollback"
+	routeHistory  = "history"
+	routeJobs     = "jobs"
+	routeQueue    = "queue"
+	routeCache    = "cache"
+	routeErrors   = "errors"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidRoute     = errors.New("invalid route")
+)
+
+// validateRoutes checks that every route name is known.
+func validateRoutes(routes []string) error {
+	for _, route := range routes {
+		if !slices.Contains([]string{routeUpdate, routeServices, routeExplain, routeRollback, routeHistory, routeJobs, routeQueue, routeCache, routeErrors}, route) {
+			return fmt.Errorf("%w: %q", ErrInvalidRoute, route)
+		}
+	}
+
+	return nil
+}
+
+// signaturePayload returns the signed message, it covers the request target so a signature can't be used on
+// another route.
+func signaturePayload(timestamp, method, target string, body []byte) []byte {
+	return slices.Concat([]byte(timestamp+"\n"+method+"\n"+target+"\n"), body)
+}
+
+// sign returns the signature header of the payload.
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest sets the signature headers of the request with the body.
+func signRequest(req *http.Request, secret string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(signatureTimestampHeader, timestamp)
+	req.Header.Set(signatureHeader, sign(secret, signaturePayload(timestamp, req.Method, req.URL.RequestURI(), body)))
+}
+
+// replayCache remembers the signatures that were already used while their timestamp is still valid.
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// check records the signature and reports if it was already used.
+func (r *replayCache) check(signature string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen == nil {
+		r.seen = map[string]time.Time{}
+	}
+
+	for key, expires := range r.seen {
+		if now.After(expires) {
+			delete(r.seen, key)
+		}
+	}
+
+	if _, ok := r.seen[signature]; ok {
+		return true
+	}
+
+	// a signature can't be valid after twice the tolerance, as it covers timestamps on both directions
+	r.seen[signature] = now.Add(2 * signatureTolerance)
+
+	return false
+}
+
+// verifySignature checks the signature of the request against the secret of every key, and returns the caller of
+// the matching key. The request body is restored so it can be read by the handler.
+func (a *authenticator) verifySignature(c echo.Context) (Caller, error) {
+	req := c.Request()
+	signature := req.Header.Get(signatureHeader)
+	timestamp := req.Header.Get(signatureTimestampHeader)
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return Caller{}, fmt.Errorf("%w: unsupported format", ErrInvalidSignature)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Caller{}, fmt.Errorf("%w: invalid timestamp", ErrInvalidSignature)
+	}
+
+	now := time.Now()
+	if diff := now.Sub(time.Unix(seconds, 0)); diff > signatureTolerance || diff < -signatureTolerance {
+		return Caller{}, fmt.Errorf("%w: stale timestamp", ErrInvalidSignature)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+	if err != nil {
+		return Caller{}, fmt.Errorf("cannot read the request body: %w", err)
+	}
+
+	if len(body) > maxSignedBody {
+		return Caller{}, fmt.Errorf("%w: request body too large", ErrInvalidSignature)
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	payload := signaturePayload(timestamp, req.Method, req.URL.RequestURI(), body)
+
+	// every key is checked, so the time doesn't depend on which one matched
+	var found *APIKey
+	for _, key := range a.keys.keys {
+		if hmac.Equal([]byte(sign(key.Key, payload)), []byte(signature)) {
+			found = key
+		}
+	}
+
+	if found == nil {
+		return Caller{}, fmt.Errorf("%w: no key matches the signature", ErrInvalidSignature)
+	}
+
+	if a.replays.check(signature, now) {
+		return Caller{}, fmt.Errorf("%w: replayed request", ErrInvalidSignature)
+	}
+
+	caller := found.caller()
+	caller.Signed = true
+
+	return caller, nil
+}
+
+// requireSignature returns a middleware that rejects the requests that weren't signed, if the route requires it.
+func (a *authenticator) requireSignature(route string) echo.MiddlewareFunc {
+	required := slices.Contains(a.signedRoutes, route)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if required && !callerFrom(c).Signed {
+				return echo.NewHTTPError(http.StatusUnauthorized, "the request must be signed")
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	test "github.com/stretchr/testify/assert"
+)
+
+const testSignedKeys = `[
+  {"name": "ci", "key": "ci-secret", "scopes": ["update", "read"], "signatureOnly": true},
+  {"name": "viewer", "key": "viewer-secret", "scopes": ["read"]}
+]`
+
+func TestSignedRequests(t *testing.T) {
+	assert := test.New(t)
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return nil, nil
+	}
+
+	filename := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(os.WriteFile(filename, []byte(testSignedKeys), 0o600))
+
+	keys, err := newKeyStore("", filename)
+	assert.NoError(err)
+
+	_, ok := keys.lookup("ci-secret")
+	assert.False(ok, "signature only keys can't be used as bearer tokens")
+
+	auth := &authenticator{keys: keys, signedRoutes: []string{routeUpdate}}
+	ts := httptest.NewServer(newServer(context.TODO(), &Swarm{client: &mock, MaxThreads: 1}, auth).echo(false))
+	defer ts.Close()
+
+	// signed and bearer requests are accepted on the routes that don't require a signature
+	ci := newRemoteClient(ts.URL, "ci-secret")
+	ci.sign = true
+	_, err = ci.Services(context.TODO())
+	assert.NoError(err)
+
+	_, err = newRemoteClient(ts.URL, "ci-secret").Services(context.TODO())
+	assert.ErrorContains(err, "401")
+
+	viewer := newRemoteClient(ts.URL, "viewer-secret")
+	_, err = viewer.Services(context.TODO())
+	assert.NoError(err)
+
+	_, err = ci.Update(context.TODO(), UpdateRequest{Services: []string{"web"}})
+	assert.NoError(err)
+
+	_, err = viewer.Update(context.TODO(), UpdateRequest{Services: []string{"web"}})
+	assert.ErrorContains(err, "the request must be signed")
+
+	send := func(body string, now time.Time, change func(req *http.Request)) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/apis/swarm/v1/update", bytes.NewBufferString(body))
+		assert.NoError(err)
+		req.Header.Set("Content-Type", "application/json")
+		signRequest(req, "ci-secret", []byte(body), now)
+		if change != nil {
+			change(req)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	body := `{"services": ["web"]}`
+	now := time.Now()
+	assert.Equal(http.StatusOK, send(body, now, nil))
+
+	// the same signature can't be used twice
+	assert.Equal(http.StatusUnauthorized, send(body, now, nil))
+
+	assert.Equal(http.StatusUnauthorized, send(body, now.Add(-2*signatureTolerance), nil))
+	assert.Equal(http.StatusUnauthorized, send(body, now.Add(2*signatureTolerance), nil))
+
+	// the signature covers the body
+	assert.Equal(http.StatusUnauthorized, send(body, now.Add(time.Second), func(req *http.Request) {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}))
+
+	assert.Equal(http.StatusUnauthorized, send(body, now.Add(2*time.Second), func(req *http.Request) {
+		req.Header.Set(signatureHeader, sign("wrong", []byte(body)))
+	}))
+
+	assert.Equal(http.StatusOK, send(body, now.Add(3*time.Second), nil))
+}
+
+func TestReplayCache(t *testing.T) {
+	assert := test.New(t)
+
+	cache := replayCache{}
+	now := time.Now()
+
+	assert.False(cache.check("a", now))
+	assert.True(cache.check("a", now.Add(time.Minute)))
+	assert.False(cache.check("b", now))
+
+	// the signatures are forgotten once their timestamp can't be valid anymore
+	assert.False(cache.check("a", now.Add(3*signatureTolerance)))
+	assert.Len(cache.seen, 1)
+}
+
+func TestValidateRoutes(t *testing.T) {
+	assert := test.New(t)
+
+	assert.NoError(validateRoutes([]string{routeUpdate, routeRollback}))
+	assert.ErrorIs(validateRoutes([]string{"deploy"}), ErrInvalidRoute)
+}
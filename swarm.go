@@ -22,22 +22,36 @@ import (
 	"fmt"
 	"log/slog"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/distribution/reference"
-	"github.com/docker/cli/cli/config"
-	"github.com/docker/cli/cli/config/credentials"
 	_ "github.com/docker/cli/cli/connhelper"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
 )
 
 const (
-	serviceLabel        string = "xyz.megpoid.swarm-updater"
-	updateOnlyLabel     string = "xyz.megpoid.swarm-updater.update-only"
-	enabledServiceLabel string = "xyz.megpoid.swarm-updater.enable"
+	serviceLabel          string = "xyz.megpoid.swarm-updater"
+	updateOnlyLabel       string = "xyz.megpoid.swarm-updater.update-only"
+	enabledServiceLabel   string = "xyz.megpoid.swarm-updater.enable"
+	canaryLabel           string = "xyz.megpoid.swarm-updater.canary"
+	canarySoakLabel       string = "xyz.megpoid.swarm-updater.canary-soak"
+	strategyLabel         string = "xyz.megpoid.swarm-updater.strategy"
+	blueGreenLabelsLabel  string = "xyz.megpoid.swarm-updater.blue-green.labels"
+	blueGreenOldLabel     string = "xyz.megpoid.swarm-updater.blue-green.old"
+	blueGreenTimeoutLabel string = "xyz.megpoid.swarm-updater.blue-green.timeout"
+	parallelismLabel      string = "xyz.megpoid.swarm-updater.parallelism"
+	delayLabel            string = "xyz.megpoid.swarm-updater.delay"
+	orderLabel            string = "xyz.megpoid.swarm-updater.order"
+	failureActionLabel    string = "xyz.megpoid.swarm-updater.failure-action"
+	credentialLabel       string = "xyz.megpoid.swarm-updater.credential"
 )
 
 // Swarm struct to handle all the service operations
@@ -46,26 +60,75 @@ type Swarm struct {
 	Blacklist   []*regexp.Regexp
 	LabelEnable bool
 	MaxThreads  int
-	// used to protect the service update when ran from cron and http endpoint at the same time
-	mu sync.Mutex
+	// Preflight enables the swarm health checks before every update run
+	Preflight       bool
+	MinReadyWorkers int
+	// DigestCacheTTL is how long the resolved image digests are reused by the next runs, they are only reused
+	// during the run that resolved them if zero
+	DigestCacheTTL time.Duration
+	// DataDir is the directory where the update history and queue are persisted, they are kept in memory if empty
+	DataDir string
+	// RegistryConcurrency limits the concurrent image lookups on each registry, zero disables the limit
+	RegistryConcurrency int
+	// QuotaReserve defers the services of a registry when its remaining pull quota is at or below it, zero disables
+	// the quota checks
+	QuotaReserve int
+	// RegistryFailureThreshold is the number of consecutive failed lookups that open the circuit breaker of a
+	// registry, zero disables it
+	RegistryFailureThreshold int
+	// Mirrors are the rules that rewrite the image names to the mirrors that are tried before their registry
+	Mirrors []mirrorRule
+	// MirrorPolicy is the image name saved on the service spec when it's resolved from a mirror, canonical or
+	// rewritten
+	MirrorPolicy string
+	// Retry is how the failed updates are retried
+	Retry RetryPolicy
+	// interval used to poll the task status while watching a rollout
+	pollInterval time.Duration
+	// last known update state of every service
+	state stateStore
+	// updates and rollbacks done by the updater
+	history historyStore
+	// image digests resolved from the registries
+	digests digestCache
+	// services being updated or rolled back, so concurrent runs don't change the same service
+	locks serviceLocks
+	// concurrency and pull quota of the registries
+	registries registryState
+	// client used to read the registry headers, a default one is used if nil
+	registry *registryClient
+	// failed updates by error class
+	errors errorCounters
+	// providers of registry credentials checked before the docker config file
+	credentials *credentialChain
 }
 
 func (c *Swarm) validService(service swarm.Service) bool {
+	valid, _ := c.serviceDecision(service)
+
+	return valid
+}
+
+// serviceDecision reports if the service is managed by the updater and, if not, the reason why.
+func (c *Swarm) serviceDecision(service swarm.Service) (bool, string) {
 	if c.LabelEnable {
 		label := service.Spec.Labels[enabledServiceLabel]
+		if strings.ToLower(label) != "true" {
+			return false, fmt.Sprintf("missing %s=true label", enabledServiceLabel)
+		}
 
-		return strings.ToLower(label) == "true"
+		return true, ""
 	}
 
 	serviceName := service.Spec.Name
 
 	for _, entry := range c.Blacklist {
 		if entry.MatchString(serviceName) {
-			return false
+			return false, fmt.Sprintf("blacklist rule %q", entry.String())
 		}
 	}
 
-	return true
+	return true, ""
 }
 
 // NewSwarm instantiates a new Docker swarm client
@@ -75,17 +138,11 @@ func NewSwarm(configDir string, opts ...client.Opt) (*Swarm, error) {
 		return nil, fmt.Errorf("failed to initialize docker client: %w", err)
 	}
 
-	configFile, err := config.Load(configDir)
-	if err != nil {
-		// https://github.com/docker/cli/issues/5075
-		slog.Warn("failed to load config", "err", err)
-	}
-
-	if !configFile.ContainsAuth() {
-		configFile.CredentialsStore = credentials.DetectDefaultStore(configFile.CredentialsStore)
-	}
-
-	return &Swarm{client: &dockerClient{apiClient: cli, configFile: configFile}, MaxThreads: 1}, nil
+	return &Swarm{
+		client:     &dockerClient{apiClient: cli, config: newConfigLoader(configDir)},
+		MaxThreads: 1,
+		registry:   newRegistryClient(RegistryOptions{}),
+	}, nil
 }
 
 func (c *Swarm) serviceList(ctx context.Context) ([]swarm.Service, error) {
@@ -97,171 +154,626 @@ func (c *Swarm) serviceList(ctx context.Context) ([]swarm.Service, error) {
 	return services, nil
 }
 
-func (c *Swarm) updateServiceWithRetries(ctx context.Context, service swarm.Service) error {
-	var err error
-	for i := 0; i < 3; i++ {
-		err = c.updateService(ctx, service)
-		if err == nil {
-			return nil
+// registryAuth returns the encoded registry auth of the image, empty if there are no credentials for it. The
+// credential providers are checked before the docker config file. A named credential, selected by the label of the
+// service, must be found on the providers, the default credentials of the registry aren't used in its place.
+func (c *Swarm) registryAuth(ctx context.Context, image, credential string) (string, error) {
+	domain := imageDomain(image)
+
+	if credential != "" {
+		if err := validateCredentialName(credential); err != nil {
+			return "", err
 		}
 
-		// check if error has "update out of sequence" in the message
-		if strings.Contains(err.Error(), "update out of sequence") {
-			slog.Debug("Service update out of sequence, retrying with updated version", "service", service.Spec.Name)
+		var auth registry.AuthConfig
+		var ok bool
+		var err error
 
-			// fetch a newer service version
-			updatedService, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if c.credentials != nil && domain != "" {
+			auth, ok, err = c.credentials.lookup(ctx, domain, credential)
 			if err != nil {
-				return fmt.Errorf("ServiceInspect failed: %w", err)
+				return "", fmt.Errorf("cannot retrieve the registry credentials: %w", err)
 			}
+		}
 
-			service.Version = updatedService.Version
-		} else {
-			return err
+		if !ok {
+			return "", errdefs.Unauthorized(fmt.Errorf("%w: %s for %s", ErrCredentialNotFound, credential, domain))
 		}
+
+		return registry.EncodeAuthConfig(auth)
 	}
 
-	return fmt.Errorf("failed to update service %s after retries", service.Spec.Name)
-}
+	if c.credentials != nil && domain != "" {
+		auth, ok, err := c.credentials.lookup(ctx, domain, "")
+		if err != nil {
+			return "", fmt.Errorf("cannot retrieve the registry credentials: %w", err)
+		}
 
-func (c *Swarm) updateService(ctx context.Context, service swarm.Service) error {
-	image := service.Spec.TaskTemplate.ContainerSpec.Image
-	updateOpts := types.ServiceUpdateOptions{}
+		if ok {
+			return registry.EncodeAuthConfig(auth)
+		}
+	}
 
-	// get docker auth
 	encodedAuth, err := c.client.RetrieveAuthTokenFromImage(image)
 	if err != nil {
-		return fmt.Errorf("cannot retrieve auth token from service's image: %w", err)
+		return "", fmt.Errorf("cannot retrieve auth token from service's image: %w", err)
 	}
 
 	// do not set auth if is an empty json object
-	if encodedAuth != "e30=" {
-		updateOpts.EncodedRegistryAuth = encodedAuth
+	if encodedAuth == "e30=" {
+		encodedAuth = ""
+	}
+
+	return encodedAuth, nil
+}
+
+// resolveImage returns the image that should be deployed in place of the service image, and the registry auth used
+// to resolve it.
+func (c *Swarm) resolveImage(ctx context.Context, image string, target imageTarget) (string, string, error) {
+	encodedAuth, err := c.registryAuth(ctx, image, target.credential)
+	if err != nil {
+		return "", "", err
 	}
 
 	// remove image hash from name
-	imageName := strings.Split(image, "@sha")[0]
+	imageName, err := target.targetImage(strings.Split(image, "@sha")[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	if target.digest != "" {
+		// deploy the requested digest, if it exists
+		newImage, err := c.verifyImageDigest(ctx, target.run, imageName, target.digest, encodedAuth)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to verify image digest: %w", err)
+		}
+
+		return c.withMirrorAuth(ctx, newImage, imageName, encodedAuth)
+	}
 
 	// fetch a newer image digest
-	service.Spec.TaskTemplate.ContainerSpec.Image, err = c.getImageDigest(ctx, imageName, updateOpts.EncodedRegistryAuth)
+	newImage, err := c.getImageDigest(ctx, target.run, imageName, encodedAuth)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get new image digest: %w", err)
+	}
+
+	return c.withMirrorAuth(ctx, newImage, imageName, encodedAuth)
+}
+
+// withMirrorAuth returns the new image with the registry auth of the mirror, if the spec was changed to it. The
+// mirrors always use their default credentials, the named credentials belong to the original registry.
+func (c *Swarm) withMirrorAuth(ctx context.Context, newImage, image, encodedAuth string) (string, string, error) {
+	if imageDomain(newImage) == imageDomain(image) {
+		return newImage, encodedAuth, nil
+	}
+
+	mirrorAuth, err := c.registryAuth(ctx, newImage, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	return newImage, mirrorAuth, nil
+}
+
+func (c *Swarm) updateService(ctx context.Context, service swarm.Service, target imageTarget) (ServiceResult, error) {
+	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	updateOpts := types.ServiceUpdateOptions{}
+	result := serviceResult(service)
+
+	var err error
+	service.Spec.TaskTemplate.ContainerSpec.Image, updateOpts.EncodedRegistryAuth, err = c.resolveImage(ctx, image, target)
 	if err != nil {
-		return fmt.Errorf("failed to get new image digest: %w", err)
+		return result, err
 	}
 
+	c.state.recordCheck(service.ID, service.Spec.TaskTemplate.ContainerSpec.Image)
+
 	if image == service.Spec.TaskTemplate.ContainerSpec.Image {
-		slog.Debug("Service is already up to date", "service", service.Spec.Name)
+		if !target.force {
+			slog.Debug("Service is already up to date", "service", service.Spec.Name)
+			result.Status = StatusUpToDate
+
+			return result, nil
+		}
 
-		return nil
+		slog.Debug("Forcing service redeploy", "service", service.Spec.Name)
 	}
 
+	result.Image = service.Spec.TaskTemplate.ContainerSpec.Image
+	result.PreviousImage = image
+
+	if target.dryRun {
+		slog.Info("Service would be updated", "service", service.Spec.Name, "image", result.Image)
+		result.Status = StatusOutdated
+
+		return result, nil
+	}
+
+	if target.force {
+		service.Spec.TaskTemplate.ForceUpdate++
+	}
+
+	canaryReplicas, canarySoak, err := canaryConfig(service.Spec.Labels)
+	if err != nil {
+		return result, err
+	}
+
+	strategy, err := serviceStrategy(service.Spec.Labels)
+	if err != nil {
+		return result, err
+	}
+
+	// the overrides are saved with the new image, so the previous spec of the service keeps the old image and config
+	updateConfig, err := updateConfigOverrides(service.Spec)
+	if err != nil {
+		return result, err
+	}
+
+	result.UpdateConfig = updateConfig
+
 	if strings.ToLower(service.Spec.Labels[updateOnlyLabel]) == "true" {
 		if service.Spec.Mode.Replicated != nil && service.Spec.Mode.Replicated.Replicas != nil {
 			*service.Spec.Mode.Replicated.Replicas = 0
 		}
+
+		// there is nothing running to be watched
+		canaryReplicas = 0
+	}
+
+	if strategy == strategyBlueGreen {
+		cloneID, err := c.updateBlueGreen(ctx, service, updateOpts)
+		if err != nil {
+			// the green service may already be running
+			return result, &appliedError{err}
+		}
+
+		if cloneID == "" {
+			result.Status = StatusSkipped
+			result.Reason = "blue/green service is scaled down"
+
+			return result, nil
+		}
+
+		// the old service was replaced by the clone
+		c.state.recordCheck(cloneID, result.Image)
+		c.state.recordUpdate(cloneID)
+		result.Status = StatusUpdated
+
+		return result, nil
+	}
+
+	service.Spec.UpdateConfig = updateConfig
+	if canaryReplicas > 0 {
+		service.Spec.UpdateConfig = canaryUpdateConfig(updateConfig, canaryReplicas, canarySoak)
+		result.UpdateConfig = service.Spec.UpdateConfig
 	}
 
 	slog.Debug("Updating service", "service", service.Spec.Name)
 	response, err := c.client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, updateOpts)
 	if err != nil {
-		return fmt.Errorf("failed to update service %s: %w", service.Spec.Name, err)
+		return result, fmt.Errorf("failed to update service %s: %w", service.Spec.Name, err)
 	}
 
 	for _, warning := range response.Warnings {
 		slog.Debug("Response with warnings", "warning", warning)
 	}
 
+	c.state.recordUpdate(service.ID)
+
 	updatedService, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
 	if err != nil {
-		return fmt.Errorf("cannot inspect service %s to check update status: %w", service.Spec.Name, err)
+		return result, &appliedError{fmt.Errorf("cannot inspect service %s to check update status: %w", service.Spec.Name, err)}
 	}
 
 	previous := updatedService.PreviousSpec.TaskTemplate.ContainerSpec.Image
 	current := updatedService.Spec.TaskTemplate.ContainerSpec.Image
 
-	if previous != current {
+	if previous != current || target.force {
 		slog.Info("Updated service", "service", service.Spec.Name, "image", current)
+		result.Status = StatusUpdated
 	} else {
 		slog.Debug("Service is already up to date", "service", service.Spec.Name)
+		result.Status = StatusUpToDate
 	}
 
-	return nil
+	if canaryReplicas > 0 {
+		if err := c.runCanary(ctx, service, canarySoak); err != nil {
+			return result, &appliedError{err}
+		}
+	}
+
+	return result, nil
+}
+
+// UpdateOptions selects the services that should be updated.
+type UpdateOptions struct {
+	// Images has the image references of the services to update
+	Images []string
+	// Targets has the image references of the services to update with the tag or digest to deploy
+	Targets []UpdateTarget
+	// Services has the names or IDs of the services to update
+	Services []string
+	// Stacks has the names of the stacks with the services to update
+	Stacks []string
+	// LabelSelector is a comma separated list of key, key=value or key!=value label requirements
+	LabelSelector string
+	// Force redeploys the selected services even if their image digest didn't change
+	Force bool
+	// DryRun resolves the image digests and reports the services that would be updated, without updating them
+	DryRun bool
+	// Caller limits the services that can be updated, and identifies the update on the history
+	Caller Caller
+	// ResumedFrom is when an interrupted update first started. When it's retried, the services changed after that
+	// aren't updated again
+	ResumedFrom time.Time
 }
 
-// UpdateServices updates all the services from a Docker swarm that matches the specified image name.
+// UpdateServices updates all the services from a Docker swarm that matches the specified image references.
 // If no images are passed then it updates all the services.
-func (c *Swarm) UpdateServices(ctx context.Context, imageName ...string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *Swarm) UpdateServices(ctx context.Context, imageName ...string) (*RunResult, error) {
+	return c.Update(ctx, UpdateOptions{Images: imageName})
+}
+
+// Update updates the services from a Docker swarm selected by the options. If no selection is passed then it
+// updates all the services.
+func (c *Swarm) Update(ctx context.Context, opts UpdateOptions) (*RunResult, error) {
+	patterns, err := parseImagePatterns(opts.Images, opts.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := parseLabelSelector(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := serviceSelector{services: opts.Services, stacks: opts.Stacks, labels: labels}
+	runID := c.digests.newRun()
 
 	services, err := c.serviceList(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get service list: %w", err)
+		return nil, fmt.Errorf("failed to get service list: %w", err)
 	}
 
-	var serviceID string
+	if c.Preflight {
+		if err := c.preflight(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var self *pendingUpdate
+	var updates []pendingUpdate
+	run := &RunResult{Services: []ServiceResult{}}
+	if len(patterns) > 0 {
+		run.Matches = make(map[string][]string, len(patterns))
+		for _, pattern := range patterns {
+			run.Matches[pattern.raw] = []string{}
+		}
+	}
+
+	for _, service := range services {
+		if !c.validService(service) {
+			slog.Debug("Service was ignored by blacklist or missing label", "service", service.Spec.Name)
+			continue
+		}
+
+		target, selected := selectService(service, patterns, selector, run)
+		target.force = selected && opts.Force
+		target.dryRun = opts.DryRun
+		target.run = runID
+		target.credential = service.Spec.Labels[credentialLabel]
+
+		allowed := opts.Caller.Access.allowsService(service)
+
+		// try to identify this service, it's always updated last. The runs that select the services by name, stack or
+		// labels only update it if it's selected
+		if _, ok := service.Spec.Labels[serviceLabel]; ok && allowed {
+			if selected || selector.empty() {
+				self = &pendingUpdate{service: service, target: target}
+			}
+			continue
+		}
+
+		if !selected {
+			continue
+		}
+
+		if !allowed {
+			result := serviceResult(service)
+			result.Status = StatusSkipped
+			result.Reason = fmt.Sprintf("not allowed for %s", opts.Caller.Identity)
+			run.add(result)
+			continue
+		}
+
+		if !opts.ResumedFrom.IsZero() && service.UpdatedAt.After(opts.ResumedFrom) {
+			slog.Info("Skipping service changed by the interrupted update", "service", service.Spec.Name)
+			result := serviceResult(service)
+			result.Status = StatusSkipped
+			result.Reason = "changed since the interrupted update started"
+			run.add(result)
+			continue
+		}
+
+		if c.Preflight && updateInProgress(service) {
+			slog.Warn("Skipping service with an update already in progress",
+				"service", service.Spec.Name, "state", service.UpdateStatus.State)
+			result := serviceResult(service)
+			result.Status = StatusSkipped
+			result.Reason = fmt.Sprintf("update in progress (%s)", service.UpdateStatus.State)
+			run.add(result)
+			continue
+		}
+
+		updates = append(updates, pendingUpdate{service: service, target: target})
+	}
 
 	sem := make(chan struct{}, c.MaxThreads)
 	var wg sync.WaitGroup
 
-	for _, service := range services {
-		if c.validService(service) {
+	var prefetched map[string]ServiceResult
+	if c.prefetchEnabled() {
+		all := updates
+		if self != nil {
+			all = append(slices.Clone(updates), *self)
+		}
+
+		// every service is updated as soon as its image is resolved, without waiting for the other registries
+		prefetched = c.prefetch(ctx, runID, all, func(update pendingUpdate) {
+			if self != nil && update.service.ID == self.service.ID {
+				return
+			}
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				run.add(c.runLockedUpdate(ctx, update.service, update.target))
+			}()
+		})
+
+		for _, update := range updates {
+			if result, ok := prefetched[update.service.ID]; ok {
+				run.add(result)
+			}
+		}
+	} else {
+		for _, update := range updates {
 			sem <- struct{}{}
 			wg.Add(1)
 
-			go func(service swarm.Service) {
+			go func(update pendingUpdate) {
 				defer wg.Done()
 				defer func() { <-sem }()
 
-				// try to identify this service
-				if _, ok := service.Spec.Labels[serviceLabel]; ok {
-					serviceID = service.ID
-					return
-				}
-
-				if len(imageName) > 0 {
-					hasMatch := false
-					for _, imageMatch := range imageName {
-						if strings.HasPrefix(service.Spec.TaskTemplate.ContainerSpec.Image, imageMatch) {
-							hasMatch = true
-							break
-						}
-					}
-
-					if !hasMatch {
-						return
-					}
-				}
-
-				if err = c.updateServiceWithRetries(ctx, service); err != nil {
-					if errors.Is(ctx.Err(), context.Canceled) {
-						slog.Error("Service update canceled", "service", service.Spec.Name)
-						return
-					}
-					slog.Error("Cannot update service", "service", service.Spec.Name, "error", err)
-				}
-			}(service)
-		} else {
-			slog.Debug("Service was ignored by blacklist or missing label", "service", service.Spec.Name)
+				run.add(c.runLockedUpdate(ctx, update.service, update.target))
+			}(update)
 		}
 	}
 
-	if serviceID != "" {
+	wg.Wait()
+
+	if !opts.DryRun {
+		c.recordHistory(actionUpdate, opts.Caller.Identity, run.Services...)
+	}
+
+	if self != nil {
+		serviceID := self.service.ID
+
+		if result, ok := prefetched[serviceID]; ok {
+			if result.Status == StatusFailed {
+				return run, fmt.Errorf("failed to update the service %s: %s", serviceID, result.Error)
+			}
+
+			run.add(result)
+			if !opts.DryRun {
+				c.recordHistory(actionUpdate, opts.Caller.Identity, result)
+			}
+
+			return run, nil
+		}
+
+		if _, err := c.locks.lock(ctx, serviceID); err != nil {
+			return run, err
+		}
+		defer c.locks.unlock(serviceID)
+
 		// refresh service
 		service, _, err := c.client.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
 		if err != nil {
-			return fmt.Errorf("cannot inspect the service %s: %w", serviceID, err)
+			return run, fmt.Errorf("cannot inspect the service %s: %w", serviceID, err)
+		}
+
+		// the updater was probably restarted by its own update
+		if !opts.ResumedFrom.IsZero() && service.UpdatedAt.After(opts.ResumedFrom) {
+			slog.Info("Skipping self update, it was done by the interrupted update")
+			return run, nil
 		}
 
-		err = c.updateServiceWithRetries(ctx, service)
+		result, err := c.updateServiceWithRetries(ctx, service, self.target)
 		if err != nil {
-			return fmt.Errorf("failed to update the service %s: %w", serviceID, err)
+			var unavailable *unavailableError
+			if !errors.As(err, &unavailable) {
+				return run, fmt.Errorf("failed to update the service %s: %w", serviceID, err)
+			}
+			c.failed(ctx, &result, err)
+		}
+		run.add(result)
+
+		if !opts.DryRun {
+			c.recordHistory(actionUpdate, opts.Caller.Identity, result)
 		}
 	}
 
-	return nil
+	return run, nil
 }
 
-func (c *Swarm) getImageDigest(ctx context.Context, image, encodedAuth string) (string, error) {
+// selectService reports if the service was selected by the image patterns and the service selector, and returns
+// the target of the first matching pattern. Every matched pattern is recorded on the run result.
+func selectService(service swarm.Service, patterns []imagePattern, selector serviceSelector, run *RunResult) (imageTarget, bool) {
+	if !selector.match(service) {
+		return imageTarget{}, false
+	}
+
+	if len(patterns) == 0 {
+		return imageTarget{}, true
+	}
+
+	var target imageTarget
+	matched := false
+
+	for _, pattern := range patterns {
+		if pattern.match(service.Spec.TaskTemplate.ContainerSpec.Image) {
+			run.addMatch(pattern.raw, service.Spec.Name)
+			// the first match decides what gets deployed
+			if !matched {
+				target = pattern.target
+			}
+			matched = true
+		}
+	}
+
+	return target, matched
+}
+
+// runLockedUpdate waits until no other run is using the service, and updates its latest version.
+func (c *Swarm) runLockedUpdate(ctx context.Context, service swarm.Service, target imageTarget) ServiceResult {
+	waited, err := c.locks.lock(ctx, service.ID)
+	if err != nil {
+		result := serviceResult(service)
+		result.Status = StatusFailed
+		result.Error = err.Error()
+
+		return result
+	}
+	defer c.locks.unlock(service.ID)
+
+	if waited {
+		// the service may have been changed by the other run
+		latest, _, err := c.client.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			result := serviceResult(service)
+			result.Status = StatusFailed
+			result.Error = err.Error()
+
+			return result
+		}
+		service = latest
+	}
+
+	return c.runUpdate(ctx, service, target)
+}
+
+// runUpdate updates the service and logs the error, if any.
+func (c *Swarm) runUpdate(ctx context.Context, service swarm.Service, target imageTarget) ServiceResult {
+	result, err := c.updateServiceWithRetries(ctx, service, target)
+	if err != nil {
+		c.failed(ctx, &result, err)
+	}
+
+	return result
+}
+
+// failed records the error on the result and logs it. The services of a registry with an open circuit breaker are
+// skipped instead.
+func (c *Swarm) failed(ctx context.Context, result *ServiceResult, err error) {
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		slog.Warn("Skipping service, its registry is unavailable", "service", result.Service,
+			"registry", unavailable.domain)
+		result.Status = StatusRegistryUnavailable
+		result.Reason = unavailable.Error()
+
+		return
+	}
+
+	c.fail(result, err)
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		slog.Error("Service update canceled", "service", result.Service)
+	} else {
+		slog.Error("Cannot update service", "service", result.Service, "error", err)
+	}
+}
+
+// inspectDigest returns the digest of the image in the registry, reusing the digests resolved by the run. The mirrors
+// of its registry are tried first, in order, and the one that resolved the digest is returned, nil if none did.
+func (c *Swarm) inspectDigest(ctx context.Context, run uint64, image, encodedAuth string) (digest.Digest, *mirrorRule, error) {
+	var failed []string
+
+	for _, mirror := range c.mirrorsOf(image) {
+		mirrorAuth, err := c.registryAuth(ctx, mirror.image, "")
+		if err == nil {
+			var dgst digest.Digest
+			dgst, err = c.digests.resolve(ctx, run, c.DigestCacheTTL, mirror.image, mirrorAuth,
+				c.registryLookup(run, c.registryClient().manifestDigest))
+			if err == nil {
+				return dgst, mirror.rule, nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return "", nil, err
+		}
+
+		slog.Warn("Cannot resolve image on mirror, trying the next one", "image", image, "mirror", mirror.image,
+			"error", err)
+		failed = append(failed, err.Error())
+	}
+
+	dgst, err := c.digests.resolve(ctx, run, c.DigestCacheTTL, image, encodedAuth, c.registryLookup(run, c.distributionDigest))
+	if err != nil {
+		if len(failed) > 0 {
+			return "", nil, fmt.Errorf("%w (mirrors: %s)", err, strings.Join(failed, "; "))
+		}
+		return "", nil, err
+	}
+
+	return dgst, nil, nil
+}
+
+// registryLookup wraps the lookup with the circuit breaker, the concurrency limit and the quota of the registry.
+func (c *Swarm) registryLookup(run uint64, lookup func(ctx context.Context, image, encodedAuth string) (digest.Digest, error),
+) func(ctx context.Context, image, encodedAuth string) (digest.Digest, error) {
+	return func(ctx context.Context, image, encodedAuth string) (digest.Digest, error) {
+		domain := imageDomain(image)
+
+		record, err := c.registries.allowLookup(ctx, domain, run, c.RegistryFailureThreshold)
+		if err != nil {
+			return "", err
+		}
+
+		release, err := c.registries.acquire(ctx, domain, c.RegistryConcurrency)
+		if err != nil {
+			record(err)
+			return "", err
+		}
+		defer release()
+
+		c.registries.consume(domain)
+
+		dgst, err := lookup(ctx, image, encodedAuth)
+		record(err)
+
+		return dgst, err
+	}
+}
+
+// distributionDigest returns the digest of the image resolved by the docker daemon.
+func (c *Swarm) distributionDigest(ctx context.Context, image, encodedAuth string) (digest.Digest, error) {
+	distributionInspect, err := c.client.DistributionInspect(ctx, image, encodedAuth)
+	if err != nil {
+		return "", err
+	}
+
+	return distributionInspect.Descriptor.Digest, nil
+}
+
+func (c *Swarm) getImageDigest(ctx context.Context, run uint64, image, encodedAuth string) (string, error) {
 	namedRef, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse image name: %w", err)
@@ -271,13 +783,42 @@ func (c *Swarm) getImageDigest(ctx context.Context, image, encodedAuth string) (
 		return "", errors.New("the image name already have a digest")
 	}
 
-	distributionInspect, err := c.client.DistributionInspect(ctx, image, encodedAuth)
+	dgst, mirror, err := c.inspectDigest(ctx, run, image, encodedAuth)
 	if err != nil {
 		return "", fmt.Errorf("failed to inspect image: %w", err)
 	}
 
 	// ensure that image gets a default tag if none is provided
-	img, err := reference.WithDigest(namedRef, distributionInspect.Descriptor.Digest)
+	img, err := reference.WithDigest(c.specName(namedRef, mirror), dgst)
+	if err != nil {
+		return "", fmt.Errorf("the image name has an invalid format: %w", err)
+	}
+
+	return reference.FamiliarString(img), nil
+}
+
+// verifyImageDigest checks that the digest exists in the registry and returns the image name pinned to it.
+func (c *Swarm) verifyImageDigest(ctx context.Context, run uint64, image string, dgst digest.Digest, encodedAuth string) (string, error) {
+	namedRef, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	canonical, err := reference.WithDigest(reference.TrimNamed(namedRef), dgst)
+	if err != nil {
+		return "", fmt.Errorf("the image name has an invalid format: %w", err)
+	}
+
+	found, mirror, err := c.inspectDigest(ctx, run, reference.FamiliarString(canonical), encodedAuth)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image: %w", err)
+	}
+
+	if found != dgst {
+		return "", fmt.Errorf("digest %s not found in registry", dgst)
+	}
+
+	img, err := reference.WithDigest(c.specName(namedRef, mirror), dgst)
 	if err != nil {
 		return "", fmt.Errorf("the image name has an invalid format: %w", err)
 	}
@@ -31,10 +31,14 @@ import (
 
 type dockerClientMock struct {
 	DistributionInspectFn        func(ctx context.Context, image, encodedAuth string) (registry.DistributionInspect, error)
+	NodeListFn                   func(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
 	RetrieveAuthTokenFromImageFn func(image string) (string, error)
+	ServiceCreateFn              func(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (swarm.ServiceCreateResponse, error)
 	ServiceUpdateFn              func(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error)
 	ServiceInspectWithRawFn      func(ctx context.Context, serviceID string, opts types.ServiceInspectOptions) (swarm.Service, []byte, error)
 	ServiceListFn                func(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceRemoveFn              func(ctx context.Context, serviceID string) error
+	TaskListFn                   func(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
 }
 
 func (s *dockerClientMock) DistributionInspect(ctx context.Context, image, encodedAuth string) (registry.DistributionInspect, error) {
@@ -45,6 +49,14 @@ func (s *dockerClientMock) DistributionInspect(ctx context.Context, image, encod
 	return registry.DistributionInspect{}, nil
 }
 
+func (s *dockerClientMock) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	if s.NodeListFn != nil {
+		return s.NodeListFn(ctx, options)
+	}
+
+	return []swarm.Node{}, nil
+}
+
 func (s *dockerClientMock) RetrieveAuthTokenFromImage(image string) (string, error) {
 	if s.RetrieveAuthTokenFromImageFn != nil {
 		return s.RetrieveAuthTokenFromImageFn(image)
@@ -53,6 +65,14 @@ func (s *dockerClientMock) RetrieveAuthTokenFromImage(image string) (string, err
 	return "", nil
 }
 
+func (s *dockerClientMock) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (swarm.ServiceCreateResponse, error) {
+	if s.ServiceCreateFn != nil {
+		return s.ServiceCreateFn(ctx, service, options)
+	}
+
+	return swarm.ServiceCreateResponse{}, nil
+}
+
 func (s *dockerClientMock) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
 	if s.ServiceUpdateFn != nil {
 		return s.ServiceUpdateFn(ctx, serviceID, version, service, options)
@@ -77,6 +97,22 @@ func (s *dockerClientMock) ServiceList(ctx context.Context, options types.Servic
 	return []swarm.Service{}, nil
 }
 
+func (s *dockerClientMock) ServiceRemove(ctx context.Context, serviceID string) error {
+	if s.ServiceRemoveFn != nil {
+		return s.ServiceRemoveFn(ctx, serviceID)
+	}
+
+	return nil
+}
+
+func (s *dockerClientMock) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	if s.TaskListFn != nil {
+		return s.TaskListFn(ctx, options)
+	}
+
+	return []swarm.Task{}, nil
+}
+
 func TestValidServiceLabel(t *testing.T) {
 	assert := test.New(t)
 
@@ -135,7 +171,7 @@ func TestUpdateServiceEmpty(t *testing.T) {
 	}
 
 	s := Swarm{client: &mock}
-	err := s.UpdateServices(context.TODO())
+	_, err := s.UpdateServices(context.TODO())
 	assert.NoError(err)
 }
 
@@ -223,6 +259,6 @@ func TestUpdateServices(t *testing.T) {
 	slog.SetDefault(slog.New(slog.DiscardHandler))
 
 	s := Swarm{client: &mock, MaxThreads: 1}
-	err := s.UpdateServices(context.TODO())
+	_, err := s.UpdateServices(context.TODO())
 	assert.NoError(err)
 }
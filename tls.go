@@ -0,0 +1,256 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// the certificate files are checked for changes at most once per interval
+const tlsReloadInterval = 10 * time.Second
+
+var (
+	ErrInvalidTLS       = errors.New("invalid tls settings")
+	ErrClientNotAllowed = errors.New("client certificate is not allowed")
+	ErrNoCACertificates = errors.New("no certificates found in the ca file")
+)
+
+// TLSOptions are the certificate of the http endpoints and, optionally, the CA bundle used to verify the client
+// certificates and the subjects that are allowed to connect.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables the verification of the client certificates
+	ClientCAFile string
+	// ClientSubjects are glob patterns of the common names allowed to connect, any verified client if empty
+	ClientSubjects []string
+}
+
+func (o TLSOptions) validate() error {
+	if o.CertFile == "" && o.KeyFile == "" {
+		if o.ClientCAFile != "" || len(o.ClientSubjects) > 0 {
+			return fmt.Errorf("%w: client certificates need a server certificate", ErrInvalidTLS)
+		}
+
+		return nil
+	}
+
+	if o.CertFile == "" || o.KeyFile == "" {
+		return fmt.Errorf("%w: both the certificate and the key are required", ErrInvalidTLS)
+	}
+
+	if len(o.ClientSubjects) > 0 && o.ClientCAFile == "" {
+		return fmt.Errorf("%w: the client subjects need a client ca", ErrInvalidTLS)
+	}
+
+	for _, pattern := range o.ClientSubjects {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: invalid subject pattern %q: %w", ErrInvalidTLS, pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// certificateLoader keeps the certificate and the client CAs loaded from their files, and loads them again when the
+// files change, like when a swarm secret or a renewed certificate is mounted.
+type certificateLoader struct {
+	options   TLSOptions
+	mu        sync.Mutex
+	checked   time.Time
+	modTimes  []time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (l *certificateLoader) files() []string {
+	files := []string{l.options.CertFile, l.options.KeyFile}
+	if l.options.ClientCAFile != "" {
+		files = append(files, l.options.ClientCAFile)
+	}
+
+	return files
+}
+
+// load reads every file, the current certificate is kept if any of them is invalid.
+func (l *certificateLoader) load() error {
+	var modTimes []time.Time
+	for _, file := range l.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTLS, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.options.CertFile, l.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTLS, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if l.options.ClientCAFile != "" {
+		data, err := os.ReadFile(l.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidTLS, err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%w: %w: %s", ErrInvalidTLS, ErrNoCACertificates, l.options.ClientCAFile)
+		}
+	}
+
+	l.cert = &cert
+	l.clientCAs = clientCAs
+	l.modTimes = modTimes
+
+	return nil
+}
+
+// changed reports if any file has a different modification time than when it was loaded.
+func (l *certificateLoader) changed() bool {
+	for i, file := range l.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// the file may be in the middle of being replaced
+			return false
+		}
+
+		if !info.ModTime().Equal(l.modTimes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// current returns the certificate and the client CAs, loading them again if the files changed.
+func (l *certificateLoader) current() (*tls.Certificate, *x509.CertPool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.checked) >= tlsReloadInterval {
+		l.checked = time.Now()
+
+		if l.changed() {
+			if err := l.load(); err != nil {
+				slog.Error("Cannot reload the tls certificate, keeping the current one", "error", err.Error())
+			} else {
+				slog.Info("Reloaded the tls certificate", "cert", l.options.CertFile)
+			}
+		}
+	}
+
+	return l.cert, l.clientCAs
+}
+
+// verifySubject rejects the client certificates whose common name doesn't match any allowed subject.
+func (l *certificateLoader) verifySubject(state tls.ConnectionState) error {
+	if len(l.options.ClientSubjects) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	subject := state.PeerCertificates[0].Subject.CommonName
+	if !matchAny(l.options.ClientSubjects, subject) {
+		slog.Warn("Rejected client certificate", "subject", subject)
+		return fmt.Errorf("%w: %s", ErrClientNotAllowed, subject)
+	}
+
+	return nil
+}
+
+// config returns the tls config of a server, the certificates are checked for changes on new connections.
+func (l *certificateLoader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := l.current()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+
+			if clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = clientCAs
+				config.VerifyConnection = l.verifySubject
+			}
+
+			return config, nil
+		},
+	}
+}
+
+// newTLSConfig loads the certificates of the options, it returns nil if tls isn't enabled.
+func newTLSConfig(options TLSOptions) (*tls.Config, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	if options.CertFile == "" {
+		return nil, nil
+	}
+
+	loader := &certificateLoader{options: options, checked: time.Now()}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+
+	return loader.config(), nil
+}
+
+// newClientTLSConfig returns the tls config of a client that trusts the CAs of the file, if any, and presents the
+// client certificate, if any. It returns nil if there is nothing to configure.
+func newClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidTLS, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: %w: %s", ErrInvalidTLS, ErrNoCACertificates, caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidTLS, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
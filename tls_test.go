@@ -0,0 +1,208 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	test "github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate signed by the parent, or a self-signed CA if the parent is nil.
+func newTestCertificate(t *testing.T, name string, serial int64, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key}
+}
+
+// write saves the certificate and its key as PEM files, and returns their names.
+func (c *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestTLSOptions(t *testing.T) {
+	assert := test.New(t)
+
+	config, err := newTLSConfig(TLSOptions{})
+	assert.NoError(err)
+	assert.Nil(config)
+
+	_, err = newTLSConfig(TLSOptions{CertFile: "server.crt"})
+	assert.ErrorIs(err, ErrInvalidTLS)
+
+	_, err = newTLSConfig(TLSOptions{ClientCAFile: "ca.crt"})
+	assert.ErrorIs(err, ErrInvalidTLS)
+
+	_, err = newTLSConfig(TLSOptions{CertFile: "server.crt", KeyFile: "server.key", ClientSubjects: []string{"ci"}})
+	assert.ErrorIs(err, ErrInvalidTLS)
+
+	_, err = newTLSConfig(TLSOptions{CertFile: "missing.crt", KeyFile: "missing.key"})
+	assert.ErrorIs(err, ErrInvalidTLS)
+}
+
+func TestCertificateReload(t *testing.T) {
+	assert := test.New(t)
+
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", 1, nil)
+	certFile, keyFile := newTestCertificate(t, "localhost", 2, ca).write(t, dir, "server")
+
+	loader := &certificateLoader{options: TLSOptions{CertFile: certFile, KeyFile: keyFile}, checked: time.Now()}
+	assert.NoError(loader.load())
+
+	cert, _ := loader.current()
+	assert.Equal(int64(2), cert.Leaf.SerialNumber.Int64())
+
+	newTestCertificate(t, "localhost", 3, ca).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(certFile, future, future))
+	assert.NoError(os.Chtimes(keyFile, future, future))
+
+	// the files aren't checked again until the interval passes
+	cert, _ = loader.current()
+	assert.Equal(int64(2), cert.Leaf.SerialNumber.Int64())
+
+	loader.checked = time.Now().Add(-tlsReloadInterval)
+	cert, _ = loader.current()
+	assert.Equal(int64(3), cert.Leaf.SerialNumber.Int64())
+
+	// an invalid file keeps the current certificate
+	assert.NoError(os.WriteFile(certFile, []byte("invalid"), 0o600))
+	future = future.Add(time.Minute)
+	assert.NoError(os.Chtimes(certFile, future, future))
+
+	loader.checked = time.Now().Add(-tlsReloadInterval)
+	cert, _ = loader.current()
+	assert.Equal(int64(3), cert.Leaf.SerialNumber.Int64())
+}
+
+func TestMutualTLS(t *testing.T) {
+	assert := test.New(t)
+
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCertificate(t, "localhost", 2, ca).write(t, dir, "server")
+	ciCert, ciKey := newTestCertificate(t, "ci-deploy", 3, ca).write(t, dir, "ci")
+	otherCert, otherKey := newTestCertificate(t, "laptop", 4, ca).write(t, dir, "other")
+	strangerCert, strangerKey := newTestCertificate(t, "ci-deploy", 5, newTestCertificate(t, "other-ca", 6, nil)).write(t, dir, "stranger")
+
+	config, err := newTLSConfig(TLSOptions{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientCAFile:   caFile,
+		ClientSubjects: []string{"ci-*"},
+	})
+	assert.NoError(err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	svr := &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }),
+		ReadHeaderTimeout: time.Second,
+	}
+	go func() { _ = svr.Serve(tls.NewListener(listener, config)) }()
+	defer svr.Close()
+
+	get := func(certFile, keyFile string) error {
+		config, err := newClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+		resp, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	assert.NoError(get(ciCert, ciKey))
+	assert.Error(get(otherCert, otherKey), "the subject isn't allowed")
+	assert.Error(get(strangerCert, strangerKey), "the certificate isn't signed by the ca")
+	assert.Error(get("", ""), "a client certificate is required")
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// updateConfigOverrides returns the update config of the service with the overrides from its labels applied.
+// The original config is returned as is if the service has no override labels.
+func updateConfigOverrides(spec swarm.ServiceSpec) (*swarm.UpdateConfig, error) {
+	labels := spec.Labels
+	parallelism, hasParallelism := labels[parallelismLabel]
+	delay, hasDelay := labels[delayLabel]
+	order, hasOrder := labels[orderLabel]
+	failureAction, hasFailureAction := labels[failureActionLabel]
+
+	if !hasParallelism && !hasDelay && !hasOrder && !hasFailureAction {
+		return spec.UpdateConfig, nil
+	}
+
+	updateConfig := swarm.UpdateConfig{}
+	if spec.UpdateConfig != nil {
+		updateConfig = *spec.UpdateConfig
+	}
+
+	if hasParallelism {
+		value, err := strconv.ParseUint(parallelism, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %w", parallelismLabel, err)
+		}
+		updateConfig.Parallelism = value
+	}
+
+	if hasDelay {
+		value, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %w", delayLabel, err)
+		}
+		updateConfig.Delay = value
+	}
+
+	if hasOrder {
+		switch order {
+		case swarm.UpdateOrderStopFirst, swarm.UpdateOrderStartFirst:
+			updateConfig.Order = order
+		default:
+			return nil, fmt.Errorf("invalid %s label: %s", orderLabel, order)
+		}
+	}
+
+	if hasFailureAction {
+		switch failureAction {
+		case swarm.UpdateFailureActionPause, swarm.UpdateFailureActionContinue, swarm.UpdateFailureActionRollback:
+			updateConfig.FailureAction = failureAction
+		default:
+			return nil, fmt.Errorf("invalid %s label: %s", failureActionLabel, failureAction)
+		}
+	}
+
+	return &updateConfig, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2025 codestation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	test "github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfigOverrides(t *testing.T) {
+	assert := test.New(t)
+
+	original := &swarm.UpdateConfig{Parallelism: 2, Monitor: time.Minute}
+	spec := swarm.ServiceSpec{UpdateConfig: original}
+
+	updateConfig, err := updateConfigOverrides(spec)
+	assert.NoError(err)
+	assert.Same(original, updateConfig)
+
+	spec.Labels = map[string]string{
+		parallelismLabel:   "1",
+		delayLabel:         "10s",
+		orderLabel:         swarm.UpdateOrderStartFirst,
+		failureActionLabel: swarm.UpdateFailureActionRollback,
+	}
+	updateConfig, err = updateConfigOverrides(spec)
+	assert.NoError(err)
+	assert.Equal(&swarm.UpdateConfig{
+		Parallelism:   1,
+		Delay:         10 * time.Second,
+		Monitor:       time.Minute,
+		Order:         swarm.UpdateOrderStartFirst,
+		FailureAction: swarm.UpdateFailureActionRollback,
+	}, updateConfig)
+	assert.Equal(uint64(2), original.Parallelism)
+
+	spec.Labels = map[string]string{orderLabel: "random"}
+	_, err = updateConfigOverrides(spec)
+	assert.Error(err)
+
+	spec.Labels = map[string]string{failureActionLabel: "explode"}
+	_, err = updateConfigOverrides(spec)
+	assert.Error(err)
+}
+
+func TestUpdateServicesResult(t *testing.T) {
+	assert := test.New(t)
+
+	newService := func() swarm.Service {
+		return swarm.Service{
+			ID: "1",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{
+					Name:   "service_foo",
+					Labels: map[string]string{parallelismLabel: "1"},
+				},
+				TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "foo:latest"}},
+			},
+			PreviousSpec: &swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}},
+		}
+	}
+	service := newService()
+
+	mock := dockerClientMock{}
+	mock.ServiceListFn = func(_ context.Context, _ types.ServiceListOptions) ([]swarm.Service, error) {
+		return []swarm.Service{newService()}, nil
+	}
+	mock.DistributionInspectFn = func(_ context.Context, _, _ string) (registry.DistributionInspect, error) {
+		return registry.DistributionInspect{Descriptor: ocispec.Descriptor{Digest: digest.Digest(newDigest)}}, nil
+	}
+	mock.ServiceInspectWithRawFn = func(_ context.Context, _ string, _ types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+		return service, nil, nil
+	}
+	var updates []*swarm.UpdateConfig
+	mock.ServiceUpdateFn = func(_ context.Context, _ string, _ swarm.Version, spec swarm.ServiceSpec, _ types.ServiceUpdateOptions) (swarm.ServiceUpdateResponse, error) {
+		updates = append(updates, spec.UpdateConfig)
+		// swarm keeps the replaced spec as the previous one
+		previous := service.Spec
+		service.PreviousSpec, service.Spec = &previous, spec
+
+		return swarm.ServiceUpdateResponse{}, nil
+	}
+
+	s := Swarm{client: &mock, MaxThreads: 1, pollInterval: time.Millisecond}
+	result, err := s.UpdateServices(context.TODO())
+	assert.NoError(err)
+	assert.Len(result.Services, 1)
+	assert.Equal(StatusUpdated, result.Services[0].Status)
+	assert.Equal("foo:latest@"+newDigest, result.Services[0].Image)
+	assert.Equal(uint64(1), result.Services[0].UpdateConfig.Parallelism)
+
+	// the overrides are saved with the new image in a single update, so a rollback returns to the old image
+	assert.Len(updates, 1)
+	assert.Equal(uint64(1), service.Spec.UpdateConfig.Parallelism)
+	assert.Equal("foo:latest@"+newDigest, service.Spec.TaskTemplate.ContainerSpec.Image)
+	assert.Nil(service.PreviousSpec.UpdateConfig)
+	assert.Equal("foo:latest", service.PreviousSpec.TaskTemplate.ContainerSpec.Image)
+}